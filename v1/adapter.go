@@ -4,9 +4,11 @@ import  "github.com/alivinco/fimpgo"
 import (
 	log "github.com/Sirupsen/logrus"
 	"time"
-	"github.com/barnybug/miflora"
 	"io/ioutil"
 	"encoding/json"
+	"sync"
+	"path/filepath"
+	"strconv"
 )
 
 type MifloraConfig struct {
@@ -15,23 +17,94 @@ type MifloraConfig struct {
 	MqttUsername string
 	MqttPassword string
 	MqttTopicGlobalPrefix string
+	MqttJsonTopic string // enables plain JSON output , for instance ble/{alias}/state . Supported placeholders are {alias} , {mac} and {type}
+	MqttJsonRetain bool
+	MqttJsonQos byte
+	Influx InfluxConfig
+	MqttCaFile string // CA bundle , used together with ssl:// server URI
+	MqttClientCertFile string
+	MqttClientKeyFile string
+	MqttInsecureSkipVerify bool // disables broker certificate verification , lab use only
 	AdapterName string // hci0
+	Adapters []string // List of adapters , for instance hci0 , hci1 . AdapterName is used if empty
+	AdapterFailureThreshold int // number of failed reads in a row after which devices are moved to another adapter
+	DisableAdapterWatchdog bool // disables automatic reset of failed adapters
+	AdapterResetMinInterval int // minimum interval between two resets of the same adapter , in seconds
+	AdapterMaxResetsPerHour int
+	MaxConnectionsPerAdapter int // max number of persistent connections held by one adapter , 3 by default
 	RetryCount int
 	DeviceAddresses []string // List of MAC addresses
+	Devices []DeviceConfig // Optional per device settings
 	PoolInterval int // interval in seconds
+	OfflineQueueFile string // file for events which couldn't be published , default is offline_queue.jsonl next to config
+	OfflineQueueMaxSize int // max number of queued events
+	OfflineQueueMaxAge int // max age of queued event in seconds
+	DisableFimpReports bool // stops publishing sensor values as FIMP events , FIMP commands are still served
+	PublishRawValues bool // adds uncalibrated value as raw_value property to FIMP sensor reports
+	Plausibility map[string]PlausibilityRule // service name -> rule , overrides built-in rule of the service
+	ReportPolicies map[string]ReportPolicy // service name -> policy of FIMP sensor reports , "default" policy is used for other services
+	PlantProfiles map[string]PlantProfile // name -> profile , overrides profiles from plant database
+	PlantDatabaseFile string // JSON export of plant database , profiles are referenced by pid . Relative to config file
+	DerivedMetrics []string // values calculated from temperature and humidity : dew_point , abs_humidity , vpd , heat_index
+	BatteryHistoryFile string // default is battery_history.json next to config
+	BatteryAlarmThresholds []int // low battery alarm levels in percent , 20 and 10 by default
+	BatteryMaxAge int // seconds , cmd.lvl.get_report is answered from cache if battery was read within this time , 3600 by default . Can be overridden by max_age property of the request
+	GattProfileDir string // directory with JSON or YAML device profiles , relative to config file
+	ServiceMode string // new , both or legacy . Controls whether soil moisture is also published as legacy sensor_humid service , both by default
+	HomeAssistant HomeAssistantConfig
+	Homie HomieConfig
+	HttpListenAddress string // enables REST API and status page , for instance :8080
+	HttpApiToken string // bearer token required by requests which change config , read or scan devices . Without token such requests are accepted only from localhost
+	MetricsListenAddress string // enables Prometheus /metrics endpoint , for instance :9110
+	History HistoryConfig
+}
+
+type DeviceConfig struct {
+	Address string
+	Alias string // Human readable name , used by outputs which need one
+	Adapter string // Adapter the device is bound to. If empty , adapter with best RSSI is selected automatically
+	Driver string // miflora by default
+	Calibration map[string]Calibration // service name -> calibration
+	Streaming bool // keeps connection open and reports notified values , only for drivers which support notifications
+	Plant string // name of plant profile , enables plant alarms and daily light integral
 }
 
 type MiFloraAd struct{
 	configPath string
 	deviceAddresses []string
-	msgTransport *fimpgo.MqttTransport
+	msgTransport FimpTransport
 	config MifloraConfig
 	runningRequests map [string]bool
+	adapters map[string]*HciAdapter
+	adapterNames []string
+	deviceAdapters map[string]string // device address -> adapter name
+	lock sync.Mutex
+	offlineQueue *OfflineQueue
+	sinks []ReadingSink
+	history *HistoryStore
+	deviceStates map[string]*DeviceState
+	plausibility *PlausibilityFilter
+	reportFilter *ReportFilter
+	forcedReports map[string]bool // devices which have to report all values after next read
+	batteryRequests map[string][]*fimpgo.FimpMessage // cmd.lvl.get_report requests waiting for read of the device
+	plantCare *PlantCare
+	batteries *BatteryTracker
+	gattSubscriptions map[string]chan struct{} // addr|characteristic -> stop channel of notification forwarding
+	streams map[string]chan struct{} // addr -> stop channel of persistent connection
+	deviceInfo *DeviceInfoCache
+	scanning bool // discovery requested over API is running
+	adapterConnections map[string]chan struct{} // adapter -> semaphore of persistent connections
 }
 
 func NewMifloraAd( configPath string ) *MiFloraAd  {
 	mi := MiFloraAd{configPath:configPath}
 	mi.runningRequests = map[string]bool{}
+	mi.deviceStates = map[string]*DeviceState{}
+	mi.forcedReports = map[string]bool{}
+	mi.batteryRequests = map[string][]*fimpgo.FimpMessage{}
+	mi.gattSubscriptions = map[string]chan struct{}{}
+	mi.streams = map[string]chan struct{}{}
+	mi.adapterConnections = map[string]chan struct{}{}
 	err := mi.loadConfig()
 	if err != nil {
 		log.Info("<Ad> Can't load config from  ",mi.configPath)
@@ -44,116 +117,217 @@ func NewMifloraAd( configPath string ) *MiFloraAd  {
 	}else {
 
 	}
+	if err := loadGattProfiles(gattProfileDir(configPath,mi.config)); err != nil {
+		log.Error("<Ad> Can't load device profiles : ",err)
+	}
+	queueFile := mi.config.OfflineQueueFile
+	if queueFile == "" {
+		queueFile = filepath.Join(filepath.Dir(configPath),"offline_queue.jsonl")
+	}
+	mi.offlineQueue = NewOfflineQueue(queueFile,mi.config.OfflineQueueMaxSize,mi.config.OfflineQueueMaxAge)
+	mi.plausibility = NewPlausibilityFilter(mi.config.Plausibility)
+	mi.reportFilter = NewReportFilter(mi.config.ReportPolicies)
+	plantProfiles, err := loadPlantProfiles(configPath,mi.config)
+	if err != nil {
+		log.Error("<Ad> Can't load plant database : ",err)
+	}
+	mi.plantCare = NewPlantCare(plantProfiles)
+	batteryFile := mi.config.BatteryHistoryFile
+	if batteryFile == "" {
+		batteryFile = filepath.Join(filepath.Dir(configPath),"battery_history.json")
+	}
+	mi.batteries = NewBatteryTracker(batteryFile,mi.config.BatteryAlarmThresholds)
+	mi.deviceInfo = NewDeviceInfoCache(filepath.Join(filepath.Dir(configPath),"device_info.json"))
 	mi.InitMessagingTransport()
+	mi.initSinks()
 
 	return &mi
 }
 
 func (mg *MiFloraAd) loadConfig() error {
-	configFileBody, err := ioutil.ReadFile(mg.configPath)
+	config, err := LoadConfig(mg.configPath)
 	if err != nil {
 		return err
 	}
+	mg.config = config
 	for _,addr := range mg.config.DeviceAddresses {
 		mg.runningRequests[addr] = false
 	}
-	err = json.Unmarshal(configFileBody, &mg.config)
-	return err
+	return nil
 }
 
-func (mg *MiFloraAd) saveConfig() {
+// LoadConfig reads config file. Devices which are configured only in Devices are added to the list of managed devices.
+func LoadConfig(configPath string) (MifloraConfig, error) {
+	var config MifloraConfig
+	configFileBody, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return config, err
+	}
+	err = json.Unmarshal(configFileBody, &config)
+	if err != nil {
+		return config, err
+	}
+	for i := range config.DeviceAddresses {
+		config.DeviceAddresses[i] = normalizeMac(config.DeviceAddresses[i])
+	}
+	for i := range config.Devices {
+		config.Devices[i].Address = normalizeMac(config.Devices[i].Address)
+	}
+	for _,dev := range config.Devices {
+		found := false
+		for _,addr := range config.DeviceAddresses {
+			if addr == dev.Address {
+				found = true
+				break
+			}
+		}
+		if !found {
+			config.DeviceAddresses = append(config.DeviceAddresses,dev.Address)
+		}
+	}
+	return config, nil
+}
 
+func (mg *MiFloraAd) saveConfig() error {
+	mg.lock.Lock()
+	configFileBody, err := json.MarshalIndent(mg.config, "", "  ")
+	mg.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(mg.configPath, configFileBody, 0644)
 }
 
 func (mg *MiFloraAd) InitMessagingTransport() error {
 	clientId := mg.config.MqttClientIdPrefix + "ble_ad"
-	mg.msgTransport = fimpgo.NewMqttTransport(mg.config.MqttServerURI, clientId, mg.config.MqttUsername, mg.config.MqttPassword, true, 1, 1)
-	mg.msgTransport.SetGlobalTopicPrefix(mg.config.MqttTopicGlobalPrefix)
-	err := mg.msgTransport.Start()
-	log.Info("<Ad> Mqtt transport connected")
+	adapterTopic := "pt:j1/mt:evt/rt:ad/rn:ble/ad:1"
+	offlineMsg, _ := fimpgo.NewStringMessage("evt.adapter.connection_report","ble","offline",nil,nil,nil).SerializeToJson()
+	transport, err := NewMqttTransport(MqttTransportConfig{
+		ServerURI:mg.config.MqttServerURI,
+		ClientID:clientId,
+		Username:mg.config.MqttUsername,
+		Password:mg.config.MqttPassword,
+		CaFile:mg.config.MqttCaFile,
+		ClientCertFile:mg.config.MqttClientCertFile,
+		ClientKeyFile:mg.config.MqttClientKeyFile,
+		InsecureSkipVerify:mg.config.MqttInsecureSkipVerify,
+		WillTopic:addGlobalPrefix(mg.config.MqttTopicGlobalPrefix,adapterTopic),
+		WillPayload:offlineMsg,
+		SubQos:1,
+		PubQos:1,
+	})
 	if err != nil {
-		log.Error("<Ad> Error connecting to broker : ", err)
+		log.Fatal("<Ad> Can't configure mqtt transport : ", err)
 	}
-	mg.msgTransport.SetMessageHandler(mg.onMqttMessage)
-	mg.msgTransport.Subscribe("pt:j1/mt:cmd/rt:ad/rn:ble/ad:1")
+	transport.SetGlobalTopicPrefix(mg.config.MqttTopicGlobalPrefix)
+	transport.SetMessageHandler(mg.onMqttMessage)
+	transport.SetOnConnectHandler(mg.onMqttConnected)
+	transport.Subscribe("pt:j1/mt:cmd/rt:ad/rn:ble/ad:1")
 //pt:j1/mt:evt/rt:dev/rn:zw/ad:1/sv:meter_elec/ad:59_0
-	mg.msgTransport.Subscribe("pt:j1/mt:cmd/rt:dev/rn:ble/ad:1/#")
+	transport.Subscribe("pt:j1/mt:cmd/rt:dev/rn:ble/ad:1/#")
+	mg.msgTransport = transport
+	err = transport.Start()
+	if err != nil {
+		log.Error("<Ad> Error connecting to broker : ", err)
+		go func() {
+			for transport.Start() != nil {
+				time.Sleep(10*time.Second)
+			}
+		}()
+	}
 	return err
 }
 
+// onMqttConnected publishes retained online status , which replaces last will message , and replays offline queue.
+func (mg *MiFloraAd) onMqttConnected() {
+	log.Info("<Ad> Mqtt transport connected")
+	onlineMsg, _ := fimpgo.NewStringMessage("evt.adapter.connection_report","ble","online",nil,nil,nil).SerializeToJson()
+	topic := mg.msgTransport.AddGlobalPrefix("pt:j1/mt:evt/rt:ad/rn:ble/ad:1")
+	if err := mg.msgTransport.PublishRaw(topic,onlineMsg,1,true); err != nil {
+		log.Error("<Ad> Can't publish online status : ", err)
+	}
+	if mg.offlineQueue.Len() > 0 {
+		mg.offlineQueue.Flush(mg.msgTransport)
+	}
+}
 
 func (mg *MiFloraAd) Start(){
+	for _,problem := range validateServiceDescriptors() {
+		log.Error("<Ad> ",problem)
+	}
+	mg.initAdapters()
+	if mg.config.MetricsListenAddress != "" {
+		mg.startMetricsServer()
+	}
+	if mg.config.HttpListenAddress != "" {
+		mg.startHttpServer()
+	}
+	go mg.flushOfflineQueue()
 	go mg.pollDevices()
 }
 
 func (mg *MiFloraAd) pollDevices(){
 	for {
-		for _,addr := range mg.config.DeviceAddresses {
-			mg.requestSensorData(addr)
-			time.Sleep(1*time.Second)
+		for _,addr := range mg.deviceList() {
+			if mg.isStreamingDevice(addr) {
+				mg.ensureStream(addr)
+				continue
+			}
+			mg.enqueueSensorRequest(addr)
 		}
 		time.Sleep(time.Duration(mg.config.PoolInterval)*time.Second)
 	}
 
 }
 
-func (mg *MiFloraAd) requestSensorData(addr string) {
-	log.Info("Requesting sensor data from :",addr)
-	defer func() {
-		mg.runningRequests[addr] = false
-	}()
-
+func (mg *MiFloraAd) requestSensorData(addr string, adapterName string) error {
+	log.Infof("Requesting sensor data from %s over %s",addr,adapterName)
+	mg.lock.Lock()
 	if mg.runningRequests[addr] {
+		mg.lock.Unlock()
 		log.Info("Another request is already running.")
-		return
+		return errReadInProgress
 	}
 	mg.runningRequests[addr]= true
-	log.Info("Reading miflora...")
-	dev := miflora.NewMiflora(addr, mg.config.AdapterName)
-
-	firmware, err := dev.ReadFirmware()
-	if err == nil {
-		mg.reportBatteryLevel(addr,firmware.Battery)
-	}
-
-	log.Infof("Firmware: %+v\n", firmware)
-	var sensors miflora.Sensors
-	for i:=0;i<mg.config.RetryCount;i++ {
-		sensors, err = dev.ReadSensors()
-		if err == nil {
-			break
-		}else {
-			log.Infof("Failed reading sensors,retrying")
-		}
-		time.Sleep(1*time.Second)
-	}
-	if err == nil {
-		log.Infof("Reporting sensors: %+v\n", sensors)
-		if sensors.Temperature < 100 && sensors.Temperature > -50 {
-			mg.reportSensor(addr,"sensor_temp",sensors.Temperature,"C")
-			mg.reportSensor(addr,"sensor_lumin",float64(sensors.Light),"Lux")
-			//mg.reportSensor(addr,"sensor_moist",float64(sensors.Moisture),"%")
-			mg.reportSensor(addr,"sensor_humid",float64(sensors.Moisture),"%")
-			mg.reportSensor(addr,"sensor_conduct",float64(sensors.Conductivity),"?")
-		}else {
-			log.Debug("Temp value is outside allowed values ")
-		}
+	mg.lock.Unlock()
+	defer func() {
+		mg.lock.Lock()
+		mg.runningRequests[addr] = false
+		mg.lock.Unlock()
+	}()
 
+	metricReadsAttempted.WithLabelValues(adapterName).Inc()
+	reading, err := mg.driverForDevice(addr).Read(addr, ReadOptions{Adapter:adapterName,RetryCount:mg.config.RetryCount})
+	if rssi, ok := mg.rssiByAdapter()[addr][adapterName]; ok {
+		reading.SetRssi(int(rssi))
 	}
+	if err != nil {
+		metricReadsFailed.WithLabelValues(adapterName).Inc()
+	}
+	mg.recordReadResult(addr,reading,err)
+	if reading.IsEmpty() {
+		mg.reportUnreachable(addr)
+	} else {
+		mg.updateDeviceInfo(reading,adapterName,false)
+	}
+	mg.publishReading(reading)
+	mg.answerBatteryRequests(addr,reading,err)
+	return err
 }
 
-func (mg *MiFloraAd) reportSensor(addr string ,service string,value float64,unit string) {
-	addr = macToFimpMac(addr)
-	fimpAddr := fimpgo.Address{MsgType:fimpgo.MsgTypeEvt,ResourceType:fimpgo.ResourceTypeDevice,ResourceName:"ble",ResourceAddress:"1",ServiceName:service,ServiceAddress:addr}
-	fimpMsg := fimpgo.NewMessage("evt.sensor.report",service,fimpgo.VTypeFloat,value,fimpgo.Props{"unit":unit},nil,nil)
-	mg.msgTransport.Publish(&fimpAddr,fimpMsg)
+func (mg *MiFloraAd) reportSensor(addr string ,value SensorValue) {
+	service := value.Service
+	props := fimpgo.Props{"unit":value.Unit}
+	if value.Calibrated && mg.config.PublishRawValues {
+		props["raw_value"] = strconv.FormatFloat(value.Raw,'f',-1,64)
+	}
+	fimpMsg := fimpgo.NewMessage("evt.sensor.report",service,fimpgo.VTypeFloat,value.Value,props,nil,nil)
+	mg.publishEvent(deviceEventAddress(service,addr),fimpMsg)
 }
 func (mg *MiFloraAd) reportBatteryLevel(addr string , level byte) {
 	service := "battery"
-	addr = macToFimpMac(addr)
-	fimpAddr := fimpgo.Address{MsgType:fimpgo.MsgTypeEvt,ResourceType:fimpgo.ResourceTypeDevice,ResourceName:"ble",ResourceAddress:"1",ServiceName:service,ServiceAddress:addr}
 	fimpMsg := fimpgo.NewMessage("evt.lvl.report",service,fimpgo.VTypeInt,level,fimpgo.Props{},nil,nil)
-	mg.msgTransport.Publish(&fimpAddr,fimpMsg)
+	mg.publishEvent(deviceEventAddress(service,addr),fimpMsg)
 
 }
 
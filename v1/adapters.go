@@ -0,0 +1,371 @@
+package main
+
+import (
+	"errors"
+	"path"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/alivinco/fimpgo"
+	"github.com/muka/go-bluetooth/api"
+)
+
+const (
+	AdapterStateUp      = "up"
+	AdapterStateFailed  = "failed"  // too many consecutive failed reads
+	AdapterStateMissing = "missing" // adapter disappeared from BlueZ (USB dongle unplugged)
+)
+
+const defaultAdapterFailureThreshold = 5
+const adapterMonitorInterval = 30 * time.Second
+const adapterRetryPeriod = 10 * time.Minute
+const adapterScanDuration = 10 * time.Second
+
+// minFailedDevices is number of distinct devices which have to fail before adapter is treated as failed ,
+// so a single dead or out of range sensor doesn't take the adapter down. Adapters with less devices fail when all of them fail.
+const minFailedDevices = 2
+
+// HciAdapter is a single bluetooth controller with its own job queue.
+// Reads on one adapter are executed sequentially, different adapters run in parallel.
+type HciAdapter struct {
+	Name          string
+	State         string
+	FailedReads   int // consecutive failed reads
+	DbusErrors    int // consecutive D-Bus errors while checking adapter
+	stateSince    time.Time
+	failedDevices map[string]bool // devices which failed since last successful read
+	resetTimes    []time.Time     // time of recent resets , used for rate limiting
+	jobs          chan adapterJob
+}
+
+// errReadInProgress is returned if the device is already being read , it says nothing about health of the adapter.
+var errReadInProgress = errors.New("another read of the device is running")
+
+// adapterJob is sensor read of the device or other operation which needs the adapter , for instance GATT passthrough.
+type adapterJob struct {
+	addr string
+	run  func()          // nil for sensor read
+	fail func(err error) // called if the job is dropped , optional
+}
+
+func NewHciAdapter(name string) *HciAdapter {
+	return &HciAdapter{Name: name, State: AdapterStateUp, stateSince: time.Now(), failedDevices: map[string]bool{}, jobs: make(chan adapterJob, 100)}
+}
+
+func (adapter *HciAdapter) resetFailures() {
+	adapter.FailedReads = 0
+	adapter.failedDevices = map[string]bool{}
+}
+
+// adapterList returns configured adapter names. Falls back to AdapterName for old configs.
+func (conf *MifloraConfig) adapterList() []string {
+	if len(conf.Adapters) > 0 {
+		return conf.Adapters
+	}
+	if conf.AdapterName != "" {
+		return []string{conf.AdapterName}
+	}
+	return []string{"hci0"}
+}
+
+// deviceConfig returns per device settings, or defaults if the device is only listed in DeviceAddresses.
+func (conf *MifloraConfig) deviceConfig(addr string) DeviceConfig {
+	addr = normalizeMac(addr)
+	for _, d := range conf.Devices {
+		if d.Address == addr {
+			return d
+		}
+	}
+	return DeviceConfig{Address: addr}
+}
+
+func (mg *MiFloraAd) initAdapters() {
+	mg.adapters = map[string]*HciAdapter{}
+	mg.adapterNames = mg.config.adapterList()
+	mg.deviceAdapters = map[string]string{}
+	for _, name := range mg.adapterNames {
+		mg.adapters[name] = NewHciAdapter(name)
+	}
+	if len(mg.adapterNames) > 1 {
+		mg.scanAdapters(adapterScanDuration)
+	}
+	mg.assignDevices()
+	for _, name := range mg.adapterNames {
+		go mg.runAdapterQueue(mg.adapters[name])
+		mg.publishAdapterStatus(mg.adapters[name])
+	}
+	go mg.monitorAdapters()
+}
+
+// scanAdapters runs discovery on all adapters ,so BlueZ has fresh RSSI values for automatic assignment.
+func (mg *MiFloraAd) scanAdapters(duration time.Duration) {
+	for _, name := range mg.adapterNames {
+		if err := api.StartDiscoveryOn(name); err != nil {
+			log.Warnf("<Ad> Can't start discovery on %s : %s", name, err)
+		}
+	}
+	time.Sleep(duration)
+	for _, name := range mg.adapterNames {
+		api.StopDiscoveryOn(name)
+	}
+}
+
+// runAdapterQueue executes jobs for one adapter.
+func (mg *MiFloraAd) runAdapterQueue(adapter *HciAdapter) {
+	for job := range adapter.jobs {
+		if mg.isAdapterResetting(adapter) {
+			log.Infof("<Ad> Adapter %s is being reset , dropping request for %s", adapter.Name, job.addr)
+			if job.fail != nil {
+				job.fail(errors.New("adapter is being reset"))
+			}
+			continue
+		}
+		if job.run != nil {
+			job.run()
+		} else {
+			err := mg.requestSensorData(job.addr, adapter.Name)
+			if err != errReadInProgress {
+				mg.onReadResult(adapter, job.addr, err)
+			}
+		}
+		time.Sleep(1 * time.Second)
+	}
+}
+
+// enqueueSensorRequest puts read job into queue of the adapter the device is assigned to.
+func (mg *MiFloraAd) enqueueSensorRequest(addr string) {
+	if mg.isStreamingDevice(addr) {
+		// device is connected permanently , next notification is reported instead
+		return
+	}
+	mg.enqueueAdapterJob(adapterJob{addr: addr})
+}
+
+// enqueueAdapterJob puts job into queue of the adapter the device is assigned to , so it doesn't collide with reads.
+func (mg *MiFloraAd) enqueueAdapterJob(job adapterJob) {
+	adapter := mg.adapterForDevice(job.addr)
+	select {
+	case adapter.jobs <- job:
+	default:
+		log.Warnf("<Ad> Job queue of %s is full, skipping request for %s", adapter.Name, job.addr)
+		if job.fail != nil {
+			job.fail(errors.New("job queue is full"))
+		}
+	}
+}
+
+func (mg *MiFloraAd) adapterForDevice(addr string) *HciAdapter {
+	mg.lock.Lock()
+	defer mg.lock.Unlock()
+	if name, ok := mg.deviceAdapters[addr]; ok {
+		return mg.adapters[name]
+	}
+	return mg.adapters[mg.adapterNames[0]]
+}
+
+// onReadResult tracks failed reads of the adapter. The adapter is failed after consecutive failures of several devices ,
+// or of all devices assigned to it.
+func (mg *MiFloraAd) onReadResult(adapter *HciAdapter, addr string, err error) {
+	mg.lock.Lock()
+	changed := false
+	if err == nil {
+		adapter.resetFailures()
+		if adapter.State == AdapterStateFailed {
+			adapter.setState(AdapterStateUp)
+			changed = true
+		}
+	} else {
+		adapter.FailedReads++
+		adapter.failedDevices[addr] = true
+		threshold := mg.config.AdapterFailureThreshold
+		if threshold == 0 {
+			threshold = defaultAdapterFailureThreshold
+		}
+		if adapter.FailedReads >= threshold && adapter.State == AdapterStateUp && mg.failedDevicesExceeded(adapter) {
+			log.Errorf("<Ad> Adapter %s failed %d times in a row on %d devices , moving devices to other adapters", adapter.Name, adapter.FailedReads, len(adapter.failedDevices))
+			adapter.setState(AdapterStateFailed)
+			changed = true
+		}
+	}
+	mg.lock.Unlock()
+	if changed {
+		mg.assignDevices()
+		mg.publishAdapterStatus(adapter)
+	}
+}
+
+// failedDevicesExceeded returns true if enough distinct devices failed on the adapter , lock must be held.
+func (mg *MiFloraAd) failedDevicesExceeded(adapter *HciAdapter) bool {
+	if len(adapter.failedDevices) >= minFailedDevices {
+		return true
+	}
+	for addr, name := range mg.deviceAdapters {
+		if name == adapter.Name && !adapter.failedDevices[addr] {
+			return false
+		}
+	}
+	return true
+}
+
+func (mg *MiFloraAd) adapterState(adapter *HciAdapter) string {
+	mg.lock.Lock()
+	defer mg.lock.Unlock()
+	return adapter.State
+}
+
+func (adapter *HciAdapter) setState(state string) {
+	adapter.State = state
+	adapter.stateSince = time.Now()
+}
+
+// monitorAdapters detects adapters which were removed or came back and rebalances devices.
+// Adapters which are failed, missing or don't respond over D-Bus are handed over to the watchdog.
+func (mg *MiFloraAd) monitorAdapters() {
+	for {
+		time.Sleep(adapterMonitorInterval)
+		var changed, broken []*HciAdapter
+		mg.lock.Lock()
+		for _, name := range mg.adapterNames {
+			adapter := mg.adapters[name]
+			if adapter.State == AdapterStateResetting {
+				continue
+			}
+			exists, err := api.AdapterExists(name)
+			if err != nil {
+				adapter.DbusErrors++
+				log.Errorf("<Ad> Can't check adapter %s : %s", name, err)
+				if adapter.DbusErrors >= dbusErrorThreshold {
+					broken = append(broken, adapter)
+				}
+				continue
+			}
+			adapter.DbusErrors = 0
+			switch {
+			case !exists && adapter.State != AdapterStateMissing:
+				log.Errorf("<Ad> Adapter %s disappeared", name)
+				adapter.setState(AdapterStateMissing)
+				changed = append(changed, adapter)
+			case exists && adapter.State == AdapterStateMissing:
+				log.Infof("<Ad> Adapter %s is back", name)
+				adapter.resetFailures()
+				adapter.setState(AdapterStateUp)
+				changed = append(changed, adapter)
+			case adapter.State == AdapterStateFailed && mg.config.DisableAdapterWatchdog && time.Since(adapter.stateSince) > adapterRetryPeriod:
+				log.Infof("<Ad> Giving adapter %s another chance", name)
+				adapter.resetFailures()
+				adapter.setState(AdapterStateUp)
+				changed = append(changed, adapter)
+			}
+			if adapter.State == AdapterStateFailed || adapter.State == AdapterStateMissing {
+				broken = append(broken, adapter)
+			}
+		}
+		mg.lock.Unlock()
+		if len(changed) > 0 {
+			mg.assignDevices()
+			for _, adapter := range changed {
+				mg.publishAdapterStatus(adapter)
+			}
+		}
+		if !mg.config.DisableAdapterWatchdog {
+			for _, adapter := range broken {
+				mg.healAdapter(adapter)
+			}
+		}
+	}
+}
+
+// assignDevices maps every device to an adapter which is up. Explicit assignment from config wins,
+// otherwise the adapter with best RSSI is used, and if RSSI is unknown the least loaded one.
+func (mg *MiFloraAd) assignDevices() {
+	rssi := mg.rssiByAdapter()
+	mg.lock.Lock()
+	defer mg.lock.Unlock()
+	load := map[string]int{}
+	assignments := map[string]string{}
+	for _, addr := range mg.config.DeviceAddresses {
+		conf := mg.config.deviceConfig(addr)
+		name := ""
+		if a, ok := mg.adapters[conf.Adapter]; ok && a.State == AdapterStateUp {
+			name = conf.Adapter
+		} else {
+			var bestRssi int16
+			for adapterName, value := range rssi[addr] {
+				if a, ok := mg.adapters[adapterName]; ok && a.State == AdapterStateUp && (name == "" || value > bestRssi) {
+					name = adapterName
+					bestRssi = value
+				}
+			}
+		}
+		if name == "" {
+			for _, adapterName := range mg.adapterNames {
+				if mg.adapters[adapterName].State == AdapterStateUp && (name == "" || load[adapterName] < load[name]) {
+					name = adapterName
+				}
+			}
+		}
+		if name == "" {
+			// all adapters are down , keeping old assignment until one of them recovers
+			name = mg.deviceAdapters[addr]
+			if name == "" {
+				name = mg.adapterNames[0]
+			}
+		}
+		if old := mg.deviceAdapters[addr]; old != "" && old != name {
+			log.Infof("<Ad> Device %s moved from %s to %s", addr, old, name)
+		}
+		assignments[addr] = name
+		load[name]++
+	}
+	mg.deviceAdapters = assignments
+}
+
+// rssiByAdapter returns last RSSI seen by BlueZ for every device per adapter.
+func (mg *MiFloraAd) rssiByAdapter() map[string]map[string]int16 {
+	result := map[string]map[string]int16{}
+	devices, err := api.GetDevices()
+	if err != nil {
+		log.Debug("<Ad> Can't load devices from BlueZ : ", err)
+		return result
+	}
+	for i := range devices {
+		props, err := devices[i].GetProperties()
+		if err != nil || props.RSSI == 0 {
+			continue
+		}
+		if result[props.Address] == nil {
+			result[props.Address] = map[string]int16{}
+		}
+		// Adapter is object path , for instance /org/bluez/hci0
+		result[props.Address][path.Base(string(props.Adapter))] = props.RSSI
+	}
+	return result
+}
+
+func (mg *MiFloraAd) publishAdapterStatus(adapter *HciAdapter) {
+	mg.lock.Lock()
+	devices := 0
+	for _, name := range mg.deviceAdapters {
+		if name == adapter.Name {
+			devices++
+		}
+	}
+	status := map[string]string{
+		"name":         adapter.Name,
+		"state":        adapter.State,
+		"devices":      strconv.Itoa(devices),
+		"failed_reads": strconv.Itoa(adapter.FailedReads),
+		"resets":       strconv.Itoa(len(adapter.resetTimes)),
+	}
+	mg.lock.Unlock()
+	msg := fimpgo.NewStrMapMessage("evt.adapter.state_report", "ble", status, fimpgo.Props{"adapter": adapter.Name}, nil, nil)
+	fimpAddr, _ := fimpgo.NewAddressFromString("pt:j1/mt:evt/rt:ad/rn:ble/ad:1")
+	mg.msgTransport.Publish(fimpAddr, msg)
+}
+
+func (mg *MiFloraAd) SendAdapterStatusReport() {
+	for _, name := range mg.adapterNames {
+		mg.publishAdapterStatus(mg.adapters[name])
+	}
+}
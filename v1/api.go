@@ -3,7 +3,6 @@ package main
 import (
     "github.com/alivinco/fimpgo/fimptype"
     "github.com/alivinco/fimpgo"
-	"github.com/labstack/gommon/log"
 	"strings"
 	"strconv"
 )
@@ -14,41 +13,45 @@ func (mg *MiFloraAd) onMqttMessage(topic string, addr *fimpgo.Address, iotMsg *f
 		case "cmd.thing.get_inclusion_report":
 			devAddr,err := iotMsg.GetStringValue()
 			if err != nil {
-				log.Error("Value is not string")
+				mg.sendAdapterErrorReport(iotMsg,ErrorInvalidValue,"value must be device address")
 				return
 			}
-			for _,a := range mg.config.DeviceAddresses {
-
-				if a == fimpMacToMac(devAddr) {
-					mg.SendInclusionReport(devAddr)
-					break
-				}
+			if !mg.isManagedDevice(devAddr) {
+				mg.sendAdapterErrorReport(iotMsg,ErrorUnknownDevice,"device "+devAddr+" is not managed by the adapter")
+				return
 			}
+			mg.SendInclusionReport(macToFimpMac(normalizeMac(devAddr)))
 		case "cmd.network.get_all_nodes":
 			mg.SendDeviceListReport()
+		case "cmd.adapter.get_state":
+			mg.SendAdapterStatusReport()
+		case "cmd.queue.get_report":
+			mg.SendQueueReport()
+		case "cmd.sensor.get_history":
+			mg.SendHistoryReport(iotMsg)
 
 
 		}
 	}else if addr.ResourceType == fimpgo.ResourceTypeDevice {
-		switch iotMsg.Type {
-		case "cmd.sensor.get_report":
-			if addr.ServiceAddress == "" {
-				log.Error("Address is empty")
-				return
-			}
-			mg.requestSensorData(fimpMacToMac(addr.ServiceAddress))
-		}
+		mg.onDeviceCommand(addr,iotMsg)
 	}
 }
 
 type DeviceListItem struct {
 	Address string `json:"address"`
+	Alias string `json:"alias"`
+	Driver string `json:"driver"`
+	Services []string `json:"services"`
 }
 
 func (mg *MiFloraAd) SendDeviceListReport() {
 	var listOfDevices []DeviceListItem
-	for _,dev := range mg.config.DeviceAddresses {
-		listOfDevices = append(listOfDevices,DeviceListItem{Address:dev})
+	for _,dev := range mg.deviceList() {
+		item := DeviceListItem{Address:dev,Alias:mg.getDeviceConfig(dev).Alias,Driver:mg.driverForDevice(dev).Name()}
+		for _,s := range mg.deviceServices(dev) {
+			item.Services = append(item.Services,s.Name)
+		}
+		listOfDevices = append(listOfDevices,item)
 	}
 
 	msg := fimpgo.NewMessage("evt.network.all_nodes_report", "ble","object", listOfDevices, nil,nil,nil)
@@ -66,171 +69,43 @@ func fimpMacToMac(addr string)string {
 	return strings.Replace(addr,"-",":",-1)
 }
 
+// deviceEventAddress returns address of event of device service , addr is in MAC format
+func deviceEventAddress(service string, addr string) *fimpgo.Address {
+	return &fimpgo.Address{MsgType:fimpgo.MsgTypeEvt,ResourceType:fimpgo.ResourceTypeDevice,ResourceName:"ble",ResourceAddress:"1",ServiceName:service,ServiceAddress:macToFimpMac(addr)}
+}
+
+// normalizeMac converts MAC address in any accepted form to the one used in config and lookups , for instance C4:7C:8D:6A:3E:8B
+func normalizeMac(addr string)string {
+	return strings.ToUpper(fimpMacToMac(strings.TrimSpace(addr)))
+}
+
 func (mg *MiFloraAd) SendInclusionReport(addr string) {
 
+	product := mg.driverForDevice(fimpMacToMac(addr)).Product()
+	meta := mg.deviceMeta(fimpMacToMac(addr))
 	report := fimptype.ThingInclusionReport{}
 	report.Type = "ble"
 	report.Address = addr
-	report.Alias = "Flower care"
+	report.Alias = mg.getDeviceConfig(fimpMacToMac(addr)).Alias
+	if report.Alias == "" {
+		report.Alias = meta.Name
+	}
 	report.CommTechnology = "ble"
 	report.PowerSource = "battery"
 	report.WakeUpInterval = strconv.Itoa(mg.config.PoolInterval)
-	report.ProductName = "Flower care"
-	report.ProductHash = "flower_care_1"
-	report.SwVersion = "1.0"
+	report.ProductName = meta.Model
+	report.ProductHash = product.Id+"_1"
+	report.SwVersion = meta.Firmware
+	report.HwVersion = meta.Hardware
 	report.Groups = []string{}
-	report.ProductId = "flower_care"
-	report.ManufacturerId = "mi"
-	report.Security = "tls"
+	report.ProductId = product.Id
+	report.ManufacturerId = meta.Manufacturer
+	report.Security = "none"
+	if mg.msgTransport.IsTls() {
+		report.Security = "tls"
+	}
 	report.Groups = []string{"ch_0"}
-
-
-	var services []fimptype.Service
-    // <Service>
-	service := fimptype.Service{}
-	service.Name = "sensor_temp"
-	service.Alias = ""
-	service.Enabled = true
-	service.Address = "/rt:dev/rn:"+report.Type+"/ad:1/sv:"+service.Name+"/ad:"+addr
-	service.Groups = []string{"ch_0"}
-	service.Interfaces = []fimptype.Interface{}
-	service.Props = map[string]interface{}{"sup_units":[]string{"C"}}
-	service.Tags = []string{}
-
-	intf := fimptype.Interface{}
-	intf.Type = "out"
-	intf.MsgType = "evt.sensor.report"
-	intf.ValueType = fimpgo.VTypeFloat
-	intf.Version = "1"
-	service.Interfaces = append(service.Interfaces,intf)
-
-	intf = fimptype.Interface{}
-	intf.Type = "in"
-	intf.MsgType = "cmd.sensor.get_report"
-	intf.ValueType = fimpgo.VTypeString
-	intf.Version = "1"
-	service.Interfaces = append(service.Interfaces,intf)
-
-
-	services = append(services,service)
-	// </Service>
-
-
-	// <Service>
-	service = fimptype.Service{}
-	service.Name = "sensor_lumin"
-	service.Alias = ""
-	service.Enabled = true
-	service.Address = "/rt:dev/rn:"+report.Type+"/ad:1/sv:"+service.Name+"/ad:"+addr
-	service.Groups = []string{"ch_0"}
-	service.Interfaces = []fimptype.Interface{}
-	service.Props = map[string]interface{}{"sup_units":[]string{"Lux"}}
-	service.Tags = []string{}
-
-	intf = fimptype.Interface{}
-	intf.Type = "out"
-	intf.MsgType = "evt.sensor.report"
-	intf.ValueType = fimpgo.VTypeFloat
-	intf.Version = "1"
-	service.Interfaces = append(service.Interfaces,intf)
-
-	intf = fimptype.Interface{}
-	intf.Type = "in"
-	intf.MsgType = "cmd.sensor.get_report"
-	intf.ValueType = fimpgo.VTypeString
-	intf.Version = "1"
-	service.Interfaces = append(service.Interfaces,intf)
-
-
-	services = append(services,service)
-	// </Service>
-
-	// <Service>
-	service = fimptype.Service{}
-	service.Name = "sensor_humid"
-	service.Alias = ""
-	service.Enabled = true
-	service.Address = "/rt:dev/rn:"+report.Type+"/ad:1/sv:"+service.Name+"/ad:"+addr
-	service.Groups = []string{"ch_0"}
-	service.Interfaces = []fimptype.Interface{}
-	service.Props = map[string]interface{}{"sup_units":[]string{"%"}}
-	service.Tags = []string{}
-
-	intf = fimptype.Interface{}
-	intf.Type = "out"
-	intf.MsgType = "evt.sensor.report"
-	intf.ValueType = fimpgo.VTypeFloat
-	intf.Version = "1"
-	service.Interfaces = append(service.Interfaces,intf)
-
-	intf = fimptype.Interface{}
-	intf.Type = "in"
-	intf.MsgType = "cmd.sensor.get_report"
-	intf.ValueType = fimpgo.VTypeString
-	intf.Version = "1"
-	service.Interfaces = append(service.Interfaces,intf)
-
-
-	services = append(services,service)
-	// </Service>
-
-	// <Service>
-	service = fimptype.Service{}
-	service.Name = "sensor_conduct"
-	service.Alias = ""
-	service.Enabled = true
-	service.Address = "/rt:dev/rn:"+report.Type+"/ad:1/sv:"+service.Name+"/ad:"+addr
-	service.Groups = []string{"ch_0"}
-	service.Interfaces = []fimptype.Interface{}
-	service.Props = map[string]interface{}{"sup_units":[]string{"?"}}
-
-	intf = fimptype.Interface{}
-	intf.Type = "out"
-	intf.MsgType = "evt.sensor.report"
-	intf.ValueType = fimpgo.VTypeFloat
-	intf.Version = "1"
-	service.Interfaces = append(service.Interfaces,intf)
-
-	intf = fimptype.Interface{}
-	intf.Type = "in"
-	intf.MsgType = "cmd.sensor.get_report"
-	intf.ValueType = fimpgo.VTypeString
-	intf.Version = "1"
-	service.Interfaces = append(service.Interfaces,intf)
-
-	service.Tags = []string{}
-	services = append(services,service)
-	// </Service>
-
-	// <Service>
-	service = fimptype.Service{}
-	service.Name = "battery"
-	service.Alias = ""
-	service.Enabled = true
-	service.Address = "/rt:dev/rn:"+report.Type+"/ad:1/sv:"+service.Name+"/ad:"+addr
-	service.Groups = []string{"ch_0"}
-	service.Interfaces = []fimptype.Interface{}
-	service.Props = map[string]interface{}{}
-
-	intf = fimptype.Interface{}
-	intf.Type = "out"
-	intf.MsgType = "evt.lvl.report"
-	intf.ValueType = fimpgo.VTypeFloat
-	intf.Version = "1"
-	service.Interfaces = append(service.Interfaces,intf)
-
-	intf = fimptype.Interface{}
-	intf.Type = "in"
-	intf.MsgType = "cmd.lvl.get_report"
-	intf.ValueType = fimpgo.VTypeString
-	intf.Version = "1"
-	service.Interfaces = append(service.Interfaces,intf)
-
-	service.Tags = []string{}
-	services = append(services,service)
-	// </Service>
-
-	report.Services = services
+	report.Services = mg.inclusionServices(fimpMacToMac(addr))
 
 	msg := fimpgo.NewMessage("evt.thing.inclusion_report", report.Type,"object", report, nil,nil,nil)
 	addrString := "pt:j1/mt:evt/rt:ad/rn:"+report.Type+"/ad:1"
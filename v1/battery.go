@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/alivinco/fimpgo"
+)
+
+// battery level is stored when it changes , or at least once a day
+const batterySampleInterval = 24 * time.Hour
+
+// batteryEstimateWindow is the period of history used for discharge slope.
+const batteryEstimateWindow = 90 * 24 * time.Hour
+
+// batteryReplacementJump is level increase which is treated as battery replacement , older history is discarded.
+const batteryReplacementJump = 20
+
+// batteryAlarmHysteresis is how much level has to rise above threshold before alarm is cleared.
+const batteryAlarmHysteresis = 5
+
+var defaultBatteryAlarmThresholds = []int{20, 10}
+
+// defaultBatteryMaxAge is used if BatteryMaxAge isn't configured.
+const defaultBatteryMaxAge = time.Hour
+
+// BatteryDriver is implemented by drivers which can read battery level without sensor values.
+// Battery level requests of devices with other drivers are served by full read of the device.
+type BatteryDriver interface {
+	// ReadBattery returns reading with battery level and firmware version only.
+	ReadBattery(addr string, opts ReadOptions) (*DeviceReading, error)
+}
+
+type batterySample struct {
+	Time  time.Time `json:"t"`
+	Level int       `json:"l"`
+}
+
+// BatteryEstimate is result of battery history analysis.
+type BatteryEstimate struct {
+	Level           int     `json:"level"`
+	DischargePerDay float64 `json:"discharge_per_day"` // percent per day
+	DaysRemaining   float64 `json:"days_remaining"`    // -1 if not enough history
+	Samples         int     `json:"samples"`
+	LowAlarm        int     `json:"low_alarm,omitempty"` // lowest crossed alarm threshold
+}
+
+// BatteryTracker keeps battery history of every device in a file and raises low battery alarms.
+type BatteryTracker struct {
+	file       string
+	thresholds []int
+	lock       sync.Mutex
+	history    map[string][]batterySample
+	alarms     map[string]int           // addr -> lowest crossed threshold
+	last       map[string]batterySample // last read level , history keeps only changes
+}
+
+func NewBatteryTracker(file string, thresholds []int) *BatteryTracker {
+	if len(thresholds) == 0 {
+		thresholds = defaultBatteryAlarmThresholds
+	}
+	bt := &BatteryTracker{file: file, thresholds: thresholds, history: map[string][]batterySample{}, alarms: map[string]int{}, last: map[string]batterySample{}}
+	body, err := ioutil.ReadFile(file)
+	if err == nil {
+		err = json.Unmarshal(body, &bt.history)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		log.Error("<Ad> Can't load battery history : ", err)
+	}
+	return bt
+}
+
+// Add stores battery level and returns true if new sample was stored , along with alarm threshold change.
+// Threshold is 0 if alarm was cleared and -1 if alarm state didn't change.
+func (bt *BatteryTracker) Add(addr string, level int, t time.Time) (stored bool, threshold int) {
+	bt.lock.Lock()
+	defer bt.lock.Unlock()
+	threshold = -1
+	bt.last[addr] = batterySample{Time: t, Level: level}
+	samples := bt.history[addr]
+	n := len(samples)
+	switch {
+	case n == 0:
+		stored = true
+	case level-samples[n-1].Level >= batteryReplacementJump:
+		samples = nil
+		stored = true
+	case level != samples[n-1].Level || t.Sub(samples[n-1].Time) >= batterySampleInterval:
+		stored = true
+	}
+	if stored {
+		samples = append(samples, batterySample{Time: t, Level: level})
+		for len(samples) > 0 && t.Sub(samples[0].Time) > batteryEstimateWindow {
+			samples = samples[1:]
+		}
+		bt.history[addr] = samples
+		bt.save()
+	}
+
+	lowest := 0
+	for _, th := range bt.thresholds {
+		if level <= th && (lowest == 0 || th < lowest) {
+			lowest = th
+		}
+	}
+	active := bt.alarms[addr]
+	if lowest != 0 && (active == 0 || lowest < active) {
+		bt.alarms[addr] = lowest
+		threshold = lowest
+	} else if active != 0 && lowest == 0 && level >= bt.maxThreshold()+batteryAlarmHysteresis {
+		delete(bt.alarms, addr)
+		threshold = 0
+	}
+	return stored, threshold
+}
+
+func (bt *BatteryTracker) maxThreshold() int {
+	max := 0
+	for _, th := range bt.thresholds {
+		if th > max {
+			max = th
+		}
+	}
+	return max
+}
+
+// save writes history to file , lock must be held.
+func (bt *BatteryTracker) save() {
+	if bt.file == "" {
+		return
+	}
+	body, err := json.Marshal(bt.history)
+	if err == nil {
+		err = ioutil.WriteFile(bt.file, body, 0644)
+	}
+	if err != nil {
+		log.Error("<Ad> Can't save battery history : ", err)
+	}
+}
+
+// Last returns last known battery level and time it was read. After restart it falls back to history.
+func (bt *BatteryTracker) Last(addr string) (level int, t time.Time, ok bool) {
+	bt.lock.Lock()
+	defer bt.lock.Unlock()
+	if s, ok := bt.last[addr]; ok {
+		return s.Level, s.Time, true
+	}
+	if samples := bt.history[addr]; len(samples) > 0 {
+		s := samples[len(samples)-1]
+		return s.Level, s.Time, true
+	}
+	return 0, time.Time{}, false
+}
+
+// Estimate fits a line to battery history and returns days until the battery is empty.
+func (bt *BatteryTracker) Estimate(addr string) (BatteryEstimate, bool) {
+	bt.lock.Lock()
+	defer bt.lock.Unlock()
+	samples := bt.history[addr]
+	if len(samples) == 0 {
+		return BatteryEstimate{}, false
+	}
+	last := samples[len(samples)-1]
+	est := BatteryEstimate{Level: last.Level, DaysRemaining: -1, Samples: len(samples), LowAlarm: bt.alarms[addr]}
+	// at least a few days of history is needed , battery level is reported in whole percents
+	if len(samples) < 3 || last.Time.Sub(samples[0].Time) < 3*24*time.Hour {
+		return est, true
+	}
+	var sumX, sumY, sumXY, sumXX float64
+	for _, s := range samples {
+		x := s.Time.Sub(samples[0].Time).Hours() / 24
+		y := float64(s.Level)
+		sumX += x
+		sumY += y
+		sumXY += x * y
+		sumXX += x * x
+	}
+	n := float64(len(samples))
+	denominator := n*sumXX - sumX*sumX
+	if denominator == 0 {
+		return est, true
+	}
+	slope := (n*sumXY - sumX*sumY) / denominator
+	est.DischargePerDay = -slope
+	if slope < 0 {
+		est.DaysRemaining = float64(last.Level) / -slope
+	}
+	return est, true
+}
+
+// trackBattery stores battery level of the reading , publishes low battery alarms and new estimate.
+func (mg *MiFloraAd) trackBattery(reading *DeviceReading) {
+	if !reading.HasBattery {
+		return
+	}
+	stored, threshold := mg.batteries.Add(reading.Address, reading.Battery, reading.Time)
+	if threshold >= 0 {
+		mg.reportBatteryAlarm(reading.Address, threshold)
+	}
+	if stored {
+		mg.sendBatteryEstimateReport(reading.Address, nil)
+	}
+}
+
+func (mg *MiFloraAd) reportBatteryAlarm(addr string, threshold int) {
+	status := "activ"
+	if threshold == 0 {
+		status = "deactiv"
+	}
+	log.Infof("<Ad> Low battery alarm of %s is %s , threshold %d", addr, status, threshold)
+	service := "battery"
+	fimpAddr := deviceEventAddress(service, addr)
+	props := fimpgo.Props{}
+	if threshold > 0 {
+		props["threshold"] = strconv.Itoa(threshold)
+	}
+	msg := fimpgo.NewStrMapMessage("evt.alarm.report", service, map[string]string{"event": "low_battery", "status": status}, props, nil, nil)
+	mg.publishEvent(fimpAddr, msg)
+}
+
+// sendBatteryEstimateReport serves cmd.battery.get_estimate , request is nil for unsolicited reports.
+func (mg *MiFloraAd) sendBatteryEstimateReport(addr string, request *fimpgo.FimpMessage) {
+	service := "battery"
+	var msg *fimpgo.FimpMessage
+	if est, ok := mg.batteries.Estimate(addr); ok {
+		msg = fimpgo.NewMessage("evt.battery.estimate_report", service, fimpgo.VTypeObject, est, nil, nil, request)
+	} else {
+		msg = fimpgo.NewNullMessage("evt.battery.estimate_report", service, nil, nil, request)
+	}
+	fimpAddr := deviceEventAddress(service, addr)
+	mg.publishEvent(fimpAddr, msg)
+}
+
+// sendBatteryLevelReport serves cmd.lvl.get_report. Cached level is reported if it's recent enough , otherwise battery of the device
+// is read again and the request is answered after the read. If the driver can't read battery on it's own , max_age triggers full read
+// of the device , which reports sensor values as well.
+func (mg *MiFloraAd) sendBatteryLevelReport(addr string, request *fimpgo.FimpMessage) {
+	service := "battery"
+	maxAge := defaultBatteryMaxAge
+	if mg.config.BatteryMaxAge > 0 {
+		maxAge = time.Duration(mg.config.BatteryMaxAge) * time.Second
+	}
+	if v, ok := request.Properties["max_age"]; ok {
+		seconds, err := strconv.Atoi(v)
+		if err != nil || seconds < 0 {
+			mg.sendErrorReport(addr, service, request, ErrorInvalidValue, "max_age must be number of seconds")
+			return
+		}
+		maxAge = time.Duration(seconds) * time.Second
+	}
+	level, readAt, ok := mg.batteries.Last(addr)
+	// streaming devices can't be read on request , their level comes with notifications
+	if ok && (time.Since(readAt) <= maxAge || mg.isStreamingDevice(addr)) {
+		mg.publishBatteryLevel(addr, level, readAt, request)
+		return
+	}
+	if mg.isStreamingDevice(addr) {
+		mg.sendErrorReport(addr, service, request, ErrorUnavailable, "battery level wasn't reported by the device yet")
+		return
+	}
+	mg.lock.Lock()
+	mg.batteryRequests[addr] = append(mg.batteryRequests[addr], request)
+	mg.lock.Unlock()
+	job := adapterJob{addr: addr, fail: func(err error) {
+		mg.answerBatteryRequests(addr, nil, err)
+	}}
+	if driver, ok := mg.driverForDevice(addr).(BatteryDriver); ok {
+		job.run = func() {
+			mg.readBattery(addr, driver)
+		}
+	}
+	mg.enqueueAdapterJob(job)
+}
+
+// readBattery reads only battery level and firmware of the device and answers waiting battery level requests.
+func (mg *MiFloraAd) readBattery(addr string, driver BatteryDriver) {
+	adapter := mg.adapterForDevice(addr).Name
+	reading, err := driver.ReadBattery(addr, ReadOptions{Adapter: adapter, RetryCount: mg.config.RetryCount})
+	if err == nil {
+		mg.filterReading(reading)
+		mg.trackBattery(reading)
+		mg.updateDeviceInfo(reading, adapter, false)
+	}
+	mg.answerBatteryRequests(addr, reading, err)
+}
+
+func (mg *MiFloraAd) publishBatteryLevel(addr string, level int, readAt time.Time, request *fimpgo.FimpMessage) {
+	service := "battery"
+	props := fimpgo.Props{"read_at": readAt.Format(time.RFC3339)}
+	msg := fimpgo.NewMessage("evt.lvl.report", service, fimpgo.VTypeInt, level, props, nil, request)
+	fimpAddr := deviceEventAddress(service, addr)
+	mg.publishEvent(fimpAddr, msg)
+}
+
+// answerBatteryRequests answers cmd.lvl.get_report requests which wait for read of the device. Reading is nil if the read wasn't done.
+func (mg *MiFloraAd) answerBatteryRequests(addr string, reading *DeviceReading, err error) {
+	mg.lock.Lock()
+	requests := mg.batteryRequests[addr]
+	delete(mg.batteryRequests, addr)
+	mg.lock.Unlock()
+	for _, request := range requests {
+		switch {
+		case reading != nil && reading.HasBattery:
+			mg.publishBatteryLevel(addr, reading.Battery, reading.Time, request)
+		case err != nil:
+			mg.sendErrorReport(addr, "battery", request, ErrorUnavailable, "read failed : "+err.Error())
+		default:
+			mg.sendErrorReport(addr, "battery", request, ErrorUnavailable, "battery level wasn't read")
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alivinco/fimpgo"
+)
+
+// batteryOnlyDriver counts full and battery reads.
+type batteryOnlyDriver struct {
+	level        int
+	err          error
+	reads        int
+	batteryReads int
+}
+
+func (d *batteryOnlyDriver) Name() string                           { return "battery_only" }
+func (d *batteryOnlyDriver) Match(name string, uuids []string) bool { return false }
+func (d *batteryOnlyDriver) Product() ProductInfo                   { return ProductInfo{Name: "Test sensor"} }
+func (d *batteryOnlyDriver) Services() []ServiceDescriptor {
+	return []ServiceDescriptor{sensorService("sensor_temp", "C"), batteryService()}
+}
+
+func (d *batteryOnlyDriver) Read(addr string, opts ReadOptions) (*DeviceReading, error) {
+	d.reads++
+	return NewDeviceReading(addr, d.Name()), errors.New("full read isn't expected")
+}
+
+func (d *batteryOnlyDriver) ReadBattery(addr string, opts ReadOptions) (*DeviceReading, error) {
+	d.batteryReads++
+	reading := NewDeviceReading(addr, d.Name())
+	if d.err == nil {
+		reading.SetBattery(d.level)
+	}
+	return reading, d.err
+}
+
+func TestStaleBatteryLevelIsReadWithoutSensors(t *testing.T) {
+	driver := &batteryOnlyDriver{level: 77}
+	registerDriver(driver)
+	defer delete(drivers, driver.Name())
+	config := MifloraConfig{DeviceAddresses: []string{testDeviceAddr}, Devices: []DeviceConfig{{Address: testDeviceAddr, Driver: driver.Name()}}}
+
+	for _, readErr := range []error{nil, errors.New("device not found")} {
+		mg, transport := newTestAdapter(t, config, nil)
+		defer os.RemoveAll(filepath.Dir(mg.configPath))
+		mg.adapterNames = []string{"hci0"}
+		mg.adapters = map[string]*HciAdapter{"hci0": NewHciAdapter("hci0")}
+		mg.deviceAdapters = map[string]string{}
+		mg.batteries.Add(testDeviceAddr, 80, time.Now().Add(-2*time.Hour))
+		// device information is known , so the device isn't connected for it
+		mg.deviceInfo.Set(testDeviceAddr, DeviceInfo{Model: "Test sensor", Manufacturer: "test", InfoReadAt: time.Now()})
+		driver.err = readErr
+
+		request := fimpgo.NewNullMessage("cmd.lvl.get_report", "battery", fimpgo.Props{"max_age": "60"}, nil, nil)
+		mg.sendBatteryLevelReport(testDeviceAddr, request)
+		if events := transport.take(); len(events) != 0 {
+			t.Fatalf("request was answered before the read : %d events", len(events))
+		}
+		job := <-mg.adapters["hci0"].jobs
+		if job.run == nil {
+			t.Fatal("battery request queued full read")
+		}
+		job.run()
+		events := transport.take()
+		assertDeclared(t, mg, events)
+		if driver.reads != 0 {
+			t.Errorf("device was read %d times", driver.reads)
+		}
+		assertNotPublished(t, events, "sensor_temp", "evt.sensor.report")
+		if readErr != nil {
+			assertPublished(t, events, "battery evt.error.report")
+			continue
+		}
+		assertPublished(t, events, "battery evt.lvl.report")
+		for _, ev := range events {
+			if ev.msg.Type == "evt.lvl.report" && ev.msg.Value != 77 {
+				t.Errorf("expected level 77 , got %v", ev.msg.Value)
+			}
+		}
+		if level, _, _ := mg.batteries.Last(testDeviceAddr); level != 77 {
+			t.Errorf("battery history wasn't updated , last level %d", level)
+		}
+	}
+	if driver.batteryReads != 2 {
+		t.Errorf("expected 2 battery reads , got %d", driver.batteryReads)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"sort"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/alivinco/fimpgo"
+)
+
+// Calibration converts raw sensor value into corrected one. If lookup table is set it's used instead of gain and offset.
+type Calibration struct {
+	Offset float64
+	Gain   *float64     // 1 if not set
+	Points [][2]float64 // pairs of raw and real value sorted by raw value , linear interpolation is used between points
+}
+
+func (c Calibration) Validate() error {
+	if c.Gain != nil && *c.Gain == 0 {
+		return errors.New("gain can't be 0")
+	}
+	if len(c.Points) == 1 {
+		return errors.New("lookup table needs at least 2 points")
+	}
+	for i := 1; i < len(c.Points); i++ {
+		if c.Points[i][0] <= c.Points[i-1][0] {
+			return errors.New("lookup table must be sorted by raw value without duplicates")
+		}
+	}
+	return nil
+}
+
+func (c Calibration) Apply(raw float64) float64 {
+	if len(c.Points) >= 2 {
+		points := append([][2]float64{}, c.Points...)
+		sort.Slice(points, func(i, j int) bool { return points[i][0] < points[j][0] })
+		// values outside of the table are extrapolated from the first or last segment
+		i := sort.Search(len(points), func(i int) bool { return points[i][0] >= raw })
+		if i == 0 {
+			i = 1
+		} else if i == len(points) {
+			i = len(points) - 1
+		}
+		p0, p1 := points[i-1], points[i]
+		return p0[1] + (raw-p0[0])*(p1[1]-p0[1])/(p1[0]-p0[0])
+	}
+	gain := 1.0
+	if c.Gain != nil {
+		gain = *c.Gain
+	}
+	return raw*gain + c.Offset
+}
+
+// calibrate applies per device calibration to all values of the reading. Raw value is kept for audit.
+func (mg *MiFloraAd) calibrate(reading *DeviceReading) {
+	calibrations := mg.getDeviceConfig(reading.Address).Calibration
+	for i := range reading.Values {
+		v := &reading.Values[i]
+		v.Raw = v.Value
+		c, ok := calibrations[v.Service]
+		if !ok {
+			// calibration could be stored under service name used by older versions
+			c, ok = calibrations[mg.legacyServicesOf(reading.Address)[v.Service]]
+		}
+		if ok {
+			v.Value = c.Apply(v.Value)
+			v.Calibrated = true
+		}
+	}
+}
+
+// setCalibration serves cmd.sensor.set_calibration . Value is calibration object , null value removes calibration.
+func (mg *MiFloraAd) setCalibration(addr string, service string, iotMsg *fimpgo.FimpMessage) {
+	var calibration *Calibration
+	if iotMsg.ValueType != fimpgo.VTypeNull {
+		calibration = &Calibration{}
+		if err := iotMsg.GetObjectValue(calibration); err != nil {
+			mg.sendErrorReport(addr, service, iotMsg, ErrorInvalidValue, "calibration must be object : "+err.Error())
+			return
+		}
+		if err := calibration.Validate(); err != nil {
+			mg.sendErrorReport(addr, service, iotMsg, ErrorInvalidValue, "invalid calibration : "+err.Error())
+			return
+		}
+	}
+	conf := mg.getDeviceConfig(addr)
+	calibrations := map[string]Calibration{}
+	for s, c := range conf.Calibration {
+		calibrations[s] = c
+	}
+	if calibration == nil {
+		delete(calibrations, service)
+	} else {
+		calibrations[service] = *calibration
+	}
+	conf.Calibration = calibrations
+	if err := mg.addDevice(conf); err != nil {
+		log.Error("<Ad> Can't save config : ", err)
+	}
+	mg.sendCalibrationReport(addr, service, iotMsg)
+}
+
+func (mg *MiFloraAd) sendCalibrationReport(addr string, service string, request *fimpgo.FimpMessage) {
+	calibration, ok := mg.getDeviceConfig(addr).Calibration[service]
+	var msg *fimpgo.FimpMessage
+	if ok {
+		msg = fimpgo.NewMessage("evt.sensor.calibration_report", service, fimpgo.VTypeObject, calibration, nil, nil, request)
+	} else {
+		msg = fimpgo.NewNullMessage("evt.sensor.calibration_report", service, nil, nil, request)
+	}
+	fimpAddr := deviceEventAddress(service, addr)
+	mg.checkDeclaredEvent(fimpAddr, msg)
+	mg.msgTransport.Publish(fimpAddr, msg)
+}
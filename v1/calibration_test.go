@@ -0,0 +1,79 @@
+package main
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/alivinco/fimpgo"
+)
+
+func TestCalibrationValidate(t *testing.T) {
+	cases := []struct {
+		name        string
+		calibration Calibration
+		valid       bool
+	}{
+		{"empty", Calibration{}, true},
+		{"offset", Calibration{Offset: -1.5}, true},
+		{"gain", Calibration{Gain: floatPtr(1.1)}, true},
+		{"negative gain", Calibration{Gain: floatPtr(-1)}, true},
+		{"zero gain", Calibration{Gain: floatPtr(0)}, false},
+		{"table", Calibration{Points: [][2]float64{{0, 0}, {10, 20}, {50, 60}}}, true},
+		{"single point", Calibration{Points: [][2]float64{{10, 20}}}, false},
+		{"unsorted points", Calibration{Points: [][2]float64{{10, 20}, {0, 0}}}, false},
+		{"duplicate points", Calibration{Points: [][2]float64{{0, 0}, {10, 20}, {10, 25}}}, false},
+	}
+	for _, c := range cases {
+		if err := c.calibration.Validate(); (err == nil) != c.valid {
+			t.Errorf("%s : expected valid %v , got %v", c.name, c.valid, err)
+		}
+	}
+}
+
+func TestCalibrationApply(t *testing.T) {
+	table := Calibration{Points: [][2]float64{{0, 0}, {10, 20}, {50, 60}}}
+	cases := []struct {
+		name        string
+		calibration Calibration
+		raw         float64
+		expected    float64
+	}{
+		{"no calibration", Calibration{}, 21.5, 21.5},
+		{"offset", Calibration{Offset: -0.5}, 21.5, 21},
+		{"gain", Calibration{Gain: floatPtr(2)}, 10, 20},
+		{"gain and offset", Calibration{Gain: floatPtr(1.5), Offset: 1}, 10, 16},
+		{"table point", table, 10, 20},
+		{"table interpolation", table, 30, 40},
+		{"table first segment", table, 5, 10},
+		{"below table", table, -5, -10},
+		{"above table", table, 70, 80},
+		{"table wins over gain", Calibration{Gain: floatPtr(3), Offset: 5, Points: table.Points}, 30, 40},
+	}
+	for _, c := range cases {
+		if v := c.calibration.Apply(c.raw); math.Abs(v-c.expected) > 1e-9 {
+			t.Errorf("%s : expected %v , got %v", c.name, c.expected, v)
+		}
+	}
+}
+
+func TestSetInvalidCalibrationIsAnswered(t *testing.T) {
+	mg, transport := newTestAdapter(t, MifloraConfig{DeviceAddresses: []string{testDeviceAddr}}, nil)
+	defer os.RemoveAll(filepath.Dir(mg.configPath))
+	for _, value := range []interface{}{map[string]interface{}{"Gain": 0}, "offset"} {
+		request := fimpgo.NewMessage("cmd.sensor.set_calibration", "sensor_temp", fimpgo.VTypeObject, value, nil, nil, nil)
+		mg.setCalibration(testDeviceAddr, "sensor_temp", request)
+		events := transport.take()
+		assertDeclared(t, mg, events)
+		if len(events) != 1 || events[0].msg.Type != "evt.error.report" || events[0].addr.ServiceName != "sensor_temp" {
+			t.Fatalf("expected error report of sensor_temp , got %d events", len(events))
+		}
+		if report, _ := events[0].msg.GetStrMapValue(); report["reason"] != ErrorInvalidValue {
+			t.Errorf("unexpected report %v", report)
+		}
+		if _, ok := mg.getDeviceConfig(testDeviceAddr).Calibration["sensor_temp"]; ok {
+			t.Error("invalid calibration was stored")
+		}
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/muka/go-bluetooth/api"
+)
+
+const defaultConfigPath = "config.json"
+
+var macRegexp = regexp.MustCompile("^([0-9A-Fa-f]{2}:){5}[0-9A-Fa-f]{2}$")
+
+func printUsage() {
+	fmt.Fprint(os.Stderr, `Usage:
+  ble-ad run -c config.json              run the adapter
+  ble-ad scan [--duration 30s] [--adapter hci0] [--profiles dir]
+                                         list nearby devices with RSSI and matched driver
+  ble-ad read [--adapter hci0] [--driver miflora] [--profiles dir] <mac>
+                                         read device once and print decoded values
+  ble-ad config validate -c config.json  check config file
+  ble-ad devices list -c config.json     list configured devices
+`)
+}
+
+func runCommand(args []string) {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	configPath := fs.String("c", defaultConfigPath, "config file")
+	fs.Parse(args)
+	runAdapter(*configPath)
+}
+
+func runAdapter(configPath string) {
+	fmt.Printf("Loading config from : %s \n", configPath)
+	ad := NewMifloraAd(configPath)
+	ad.Start()
+	select {}
+}
+
+func scanCommand(args []string) {
+	fs := flag.NewFlagSet("scan", flag.ExitOnError)
+	duration := fs.Duration("duration", 10*time.Second, "discovery duration")
+	adapter := fs.String("adapter", "hci0", "adapter used for discovery")
+	profileDir := fs.String("profiles", "", "directory with device profiles")
+	fs.Parse(args)
+	loadProfilesOrExit(*profileDir)
+	defer api.Exit()
+
+	fmt.Printf("Scanning on %s for %s ...\n", *adapter, *duration)
+	if err := api.StartDiscoveryOn(*adapter); err != nil {
+		fmt.Fprintln(os.Stderr, "Can't start discovery : ", err)
+		os.Exit(1)
+	}
+	time.Sleep(*duration)
+	api.StopDiscoveryOn(*adapter)
+
+	devices, err := api.GetDevices()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Can't load devices : ", err)
+		os.Exit(1)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ADDRESS\tNAME\tRSSI\tADAPTER\tDRIVER")
+	for i := range devices {
+		props, err := devices[i].GetProperties()
+		if err != nil || props.RSSI == 0 {
+			// devices without RSSI are only cached by BlueZ and were not seen during this scan
+			continue
+		}
+		driver := matchDriver(props.Name, props.UUIDs)
+		if driver == "" {
+			driver = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n", props.Address, props.Name, props.RSSI, path.Base(string(props.Adapter)), driver)
+	}
+	w.Flush()
+}
+
+func readCommand(args []string) {
+	fs := flag.NewFlagSet("read", flag.ExitOnError)
+	adapter := fs.String("adapter", "hci0", "adapter")
+	driverName := fs.String("driver", defaultDriver, "driver , one of : "+driverNames())
+	retryCount := fs.Int("retry", 3, "number of read attempts")
+	profileDir := fs.String("profiles", "", "directory with device profiles")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		printUsage()
+		os.Exit(2)
+	}
+	// flags are accepted also after mac address
+	mac := fs.Arg(0)
+	fs.Parse(fs.Args()[1:])
+	loadProfilesOrExit(*profileDir)
+	mac = normalizeMac(mac)
+	driver, ok := drivers[*driverName]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown driver %s , supported drivers : %s\n", *driverName, driverNames())
+		os.Exit(2)
+	}
+	reading, err := driver.Read(mac, ReadOptions{Adapter: *adapter, RetryCount: *retryCount})
+	printReading(reading)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Read failed : ", err)
+		os.Exit(1)
+	}
+}
+
+func loadProfilesOrExit(dir string) {
+	if err := loadGattProfiles(dir); err != nil {
+		fmt.Fprintln(os.Stderr, "Can't load device profiles : ", err)
+		os.Exit(1)
+	}
+}
+
+func printReading(reading *DeviceReading) {
+	if reading == nil || reading.IsEmpty() {
+		fmt.Println("No values")
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SERVICE\tVALUE\tUNIT")
+	for _, v := range reading.Values {
+		fmt.Fprintf(w, "%s\t%v\t%s\n", v.Service, v.Value, v.Unit)
+	}
+	if reading.HasBattery {
+		fmt.Fprintf(w, "battery\t%d\t%%\n", reading.Battery)
+	}
+	w.Flush()
+}
+
+func configCommand(args []string) {
+	if len(args) == 0 || args[0] != "validate" {
+		printUsage()
+		os.Exit(2)
+	}
+	fs := flag.NewFlagSet("config validate", flag.ExitOnError)
+	configPath := fs.String("c", defaultConfigPath, "config file")
+	fs.Parse(args[1:])
+	problems := validateConfigFile(*configPath)
+	if len(problems) == 0 {
+		fmt.Printf("%s is valid\n", *configPath)
+		return
+	}
+	for _, p := range problems {
+		fmt.Println(" - " + p)
+	}
+	os.Exit(1)
+}
+
+// validateConfigFile returns list of problems found in config file.
+func validateConfigFile(configPath string) []string {
+	body, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	var problems []string
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.DisallowUnknownFields()
+	var strict MifloraConfig
+	if err := dec.Decode(&strict); err != nil {
+		problems = append(problems, "json : "+err.Error())
+	}
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		return problems
+	}
+	// profile drivers have to be registered before device drivers are checked
+	if err := loadGattProfiles(gattProfileDir(configPath, config)); err != nil {
+		problems = append(problems, "device profiles : "+err.Error())
+	}
+	problems = append(problems, validateServiceDescriptors()...)
+	return append(problems, validateConfig(configPath, config)...)
+}
+
+func validateConfig(configPath string, config MifloraConfig) []string {
+	var problems []string
+	if config.MqttServerURI == "" {
+		problems = append(problems, "MqttServerURI is empty")
+	}
+	for _, f := range []string{config.MqttCaFile, config.MqttClientCertFile, config.MqttClientKeyFile} {
+		if f == "" {
+			continue
+		}
+		if _, err := os.Stat(f); err != nil {
+			problems = append(problems, "can't access "+f)
+		}
+		if !isTlsURI(config.MqttServerURI) {
+			problems = append(problems, f+" is set , but MqttServerURI "+config.MqttServerURI+" doesn't use TLS , use ssl:// , tls:// or wss://")
+		}
+	}
+	if config.PoolInterval <= 0 {
+		problems = append(problems, "PoolInterval must be positive")
+	}
+	if config.RetryCount <= 0 {
+		problems = append(problems, "RetryCount must be positive , otherwise sensors are never read")
+	}
+	if config.MqttJsonQos > 2 {
+		problems = append(problems, "MqttJsonQos must be 0 , 1 or 2")
+	}
+	seen := map[string]bool{}
+	for _, addr := range config.DeviceAddresses {
+		if seen[addr] {
+			problems = append(problems, "device "+addr+" is listed twice")
+			continue
+		}
+		seen[addr] = true
+		problems = append(problems, validateDevice(config.deviceConfig(addr), config.adapterList())...)
+	}
+	for service, rule := range config.Plausibility {
+		if err := rule.Validate(); err != nil {
+			problems = append(problems, fmt.Sprintf("Plausibility rule of %s : %s", service, err))
+		}
+	}
+	for service, p := range config.ReportPolicies {
+		if p.Deadband < 0 || p.DeadbandPercent < 0 || p.Heartbeat < 0 {
+			problems = append(problems, "ReportPolicies of "+service+" can't have negative values")
+		}
+	}
+	plantProfiles, err := loadPlantProfiles(configPath, config)
+	if err != nil {
+		problems = append(problems, "can't load plant database : "+err.Error())
+	}
+	for _, dev := range config.Devices {
+		if _, ok := plantProfiles[strings.ToLower(dev.Plant)]; dev.Plant != "" && !ok {
+			problems = append(problems, fmt.Sprintf("device %s has unknown plant %s", dev.Address, dev.Plant))
+		}
+	}
+	for _, name := range config.DerivedMetrics {
+		if _, ok := derivedMetrics[name]; !ok {
+			problems = append(problems, "unknown derived metric "+name)
+		}
+	}
+	for _, th := range config.BatteryAlarmThresholds {
+		if th <= 0 || th >= 100 {
+			problems = append(problems, "BatteryAlarmThresholds must be between 1 and 99")
+		}
+	}
+	if config.BatteryMaxAge < 0 {
+		problems = append(problems, "BatteryMaxAge can't be negative")
+	}
+	if !isValidServiceMode(config.ServiceMode) {
+		problems = append(problems, "ServiceMode must be new , both or legacy")
+	}
+	if config.Influx.Enabled && config.Influx.URL == "" {
+		problems = append(problems, "Influx.URL is empty")
+	}
+	return problems
+}
+
+// validateDevice returns list of problems of device settings , adapters are names of configured adapters.
+// It's used for config file and for devices added over HTTP API.
+func validateDevice(dev DeviceConfig, adapters []string) []string {
+	var problems []string
+	if !macRegexp.MatchString(dev.Address) {
+		problems = append(problems, "invalid device address "+dev.Address)
+	}
+	if dev.Adapter != "" {
+		found := false
+		for _, name := range adapters {
+			found = found || name == dev.Adapter
+		}
+		if !found {
+			problems = append(problems, fmt.Sprintf("device %s is bound to adapter %s which is not configured", dev.Address, dev.Adapter))
+		}
+	}
+	if _, ok := drivers[dev.Driver]; dev.Driver != "" && !ok {
+		problems = append(problems, fmt.Sprintf("device %s has unknown driver %s", dev.Address, dev.Driver))
+	} else if dev.Streaming {
+		driver := drivers[dev.Driver]
+		if dev.Driver == "" {
+			driver = drivers[defaultDriver]
+		}
+		if sd, ok := driver.(StreamingDriver); !ok || !sd.CanStream() {
+			problems = append(problems, fmt.Sprintf("device %s has streaming enabled , but it's driver doesn't support notifications", dev.Address))
+		}
+	}
+	for service, c := range dev.Calibration {
+		if err := c.Validate(); err != nil {
+			problems = append(problems, fmt.Sprintf("device %s , calibration of %s : %s", dev.Address, service, err))
+		}
+	}
+	return problems
+}
+
+func devicesCommand(args []string) {
+	if len(args) == 0 || args[0] != "list" {
+		printUsage()
+		os.Exit(2)
+	}
+	fs := flag.NewFlagSet("devices list", flag.ExitOnError)
+	configPath := fs.String("c", defaultConfigPath, "config file")
+	fs.Parse(args[1:])
+	config, err := LoadConfig(*configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Can't load config : ", err)
+		os.Exit(1)
+	}
+	addresses := append([]string{}, config.DeviceAddresses...)
+	sort.Strings(addresses)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ADDRESS\tALIAS\tADAPTER\tDRIVER")
+	for _, addr := range addresses {
+		dev := config.deviceConfig(addr)
+		adapter := dev.Adapter
+		if adapter == "" {
+			adapter = "auto"
+		}
+		driver := dev.Driver
+		if driver == "" {
+			driver = defaultDriver
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", addr, dev.Alias, adapter, driver)
+	}
+	w.Flush()
+}
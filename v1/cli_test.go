@@ -0,0 +1,38 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestValidateConfigTlsFiles(t *testing.T) {
+	ca, err := ioutil.TempFile("", "ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca.Close()
+	defer os.Remove(ca.Name())
+	cases := []struct {
+		uri   string
+		valid bool
+	}{
+		{"tcp://localhost:1883", false},
+		{"ssl://localhost:8883", true},
+		{"tls://localhost:8883", true},
+		{"wss://localhost:443", true},
+	}
+	for _, c := range cases {
+		config := MifloraConfig{MqttServerURI: c.uri, MqttCaFile: ca.Name(), PoolInterval: 60, RetryCount: 1}
+		var tlsProblems []string
+		for _, p := range validateConfig("", config) {
+			if strings.Contains(p, "TLS") {
+				tlsProblems = append(tlsProblems, p)
+			}
+		}
+		if (len(tlsProblems) == 0) != c.valid {
+			t.Errorf("%s : expected valid %v , got %v", c.uri, c.valid, tlsProblems)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/alivinco/fimpgo"
+)
+
+// Reasons of evt.error.report
+const (
+	ErrorUnknownDevice      = "unknown_device"
+	ErrorUnsupportedCommand = "unsupported_command"
+	ErrorInvalidValue       = "invalid_value"
+	ErrorUnavailable        = "unavailable"
+)
+
+// deviceCommandHandler serves a command sent to a service of a device , addr is in MAC format.
+type deviceCommandHandler func(mg *MiFloraAd, addr string, service string, msg *fimpgo.FimpMessage)
+
+// deviceCommandHandlers are keyed by message type. Every "in" interface declared in service descriptors must have a handler.
+var deviceCommandHandlers = map[string]deviceCommandHandler{
+	"cmd.sensor.get_report": func(mg *MiFloraAd, addr string, service string, msg *fimpgo.FimpMessage) {
+		mg.requestReport(addr)
+	},
+	"cmd.sensor.set_calibration": func(mg *MiFloraAd, addr string, service string, msg *fimpgo.FimpMessage) {
+		mg.setCalibration(addr, service, msg)
+	},
+	"cmd.sensor.get_calibration": func(mg *MiFloraAd, addr string, service string, msg *fimpgo.FimpMessage) {
+		mg.sendCalibrationReport(addr, service, msg)
+	},
+	"cmd.lvl.get_report": func(mg *MiFloraAd, addr string, service string, msg *fimpgo.FimpMessage) {
+		mg.sendBatteryLevelReport(addr, msg)
+	},
+	"cmd.battery.get_estimate": func(mg *MiFloraAd, addr string, service string, msg *fimpgo.FimpMessage) {
+		mg.sendBatteryEstimateReport(addr, msg)
+	},
+	"cmd.gatt.get_services": gattCommandHandler,
+	"cmd.gatt.read":         gattCommandHandler,
+	"cmd.gatt.write":        gattCommandHandler,
+	"cmd.gatt.subscribe":    gattCommandHandler,
+	"cmd.gatt.unsubscribe":  gattCommandHandler,
+}
+
+func gattCommandHandler(mg *MiFloraAd, addr string, service string, msg *fimpgo.FimpMessage) {
+	mg.onGattCommand(addr, msg)
+}
+
+// errorReportInterface is added to every service which accepts commands.
+var errorReportInterface = InterfaceDescriptor{"out", "evt.error.report", fimpgo.VTypeStrMap}
+
+// onDeviceCommand dispatches command to handler , commands which are not declared for the service are answered with error report.
+func (mg *MiFloraAd) onDeviceCommand(fimpAddr *fimpgo.Address, msg *fimpgo.FimpMessage) {
+	if fimpAddr.ServiceAddress == "" {
+		log.Error("<Ad> Address is empty")
+		return
+	}
+	addr := normalizeMac(fimpAddr.ServiceAddress)
+	if !mg.isManagedDevice(addr) {
+		mg.sendErrorReport(addr, fimpAddr.ServiceName, msg, ErrorUnknownDevice, "device is not managed by the adapter")
+		return
+	}
+	service, ok := mg.findDeviceService(addr, fimpAddr.ServiceName)
+	if !ok {
+		mg.sendErrorReport(addr, fimpAddr.ServiceName, msg, ErrorUnsupportedCommand, "device doesn't have service "+fimpAddr.ServiceName)
+		return
+	}
+	handler, ok := deviceCommandHandlers[msg.Type]
+	if _, declared := service.Interface("in", msg.Type); !declared || !ok {
+		mg.sendErrorReport(addr, service.Name, msg, ErrorUnsupportedCommand, fmt.Sprintf("service %s doesn't support %s", service.Name, msg.Type))
+		return
+	}
+	handler(mg, addr, service.Name, msg)
+}
+
+func newErrorReport(service string, request *fimpgo.FimpMessage, reason string, message string) *fimpgo.FimpMessage {
+	value := map[string]string{"command": request.Type, "reason": reason, "message": message}
+	return fimpgo.NewStrMapMessage("evt.error.report", service, value, nil, nil, request)
+}
+
+// sendErrorReport answers device command which can't be served.
+func (mg *MiFloraAd) sendErrorReport(addr string, service string, request *fimpgo.FimpMessage, reason string, message string) {
+	log.Warnf("<Ad> Can't serve %s for %s/%s : %s", request.Type, addr, service, message)
+	msg := newErrorReport(service, request, reason, message)
+	fimpAddr := deviceEventAddress(service, addr)
+	mg.msgTransport.Publish(fimpAddr, msg)
+}
+
+// sendAdapterErrorReport answers adapter command which can't be served.
+func (mg *MiFloraAd) sendAdapterErrorReport(request *fimpgo.FimpMessage, reason string, message string) {
+	log.Warnf("<Ad> Can't serve %s : %s", request.Type, message)
+	fimpAddr, _ := fimpgo.NewAddressFromString("pt:j1/mt:evt/rt:ad/rn:ble/ad:1")
+	mg.msgTransport.Publish(fimpAddr, newErrorReport("ble", request, reason, message))
+}
+
+// validateCommandHandlers checks that every declared command has a handler.
+func validateCommandHandlers(owner string, services []ServiceDescriptor) []string {
+	var problems []string
+	for _, s := range services {
+		for _, i := range s.Interfaces {
+			if _, ok := deviceCommandHandlers[i.MsgType]; i.Type == "in" && !ok {
+				problems = append(problems, fmt.Sprintf("%s , service %s : command %s has no handler", owner, s.Name, i.MsgType))
+			}
+		}
+	}
+	return problems
+}
+
+// adapterServiceDescriptors returns services which the adapter adds to devices on top of driver services.
+func adapterServiceDescriptors() []ServiceDescriptor {
+	services := []ServiceDescriptor{plantAlarmService(), gattPassthroughService(), derivedSensorService("sensor_dli", dliUnit)}
+	var names []string
+	for name := range derivedMetrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		services = append(services, derivedSensorService(derivedMetrics[name].Service, derivedMetrics[name].Unit))
+	}
+	return services
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"math"
+)
+
+// derivedMetric is a value calculated from temperature (C) and relative humidity (%) of the same read.
+type derivedMetric struct {
+	Service string
+	Unit    string
+	Calc    func(temp float64, humid float64) float64
+}
+
+// derivedMetrics are keyed by names used in DerivedMetrics config.
+var derivedMetrics = map[string]derivedMetric{
+	"dew_point":    {"sensor_dew", "C", dewPoint},
+	"abs_humidity": {"sensor_abs_humid", "g/m3", absoluteHumidity},
+	"vpd":          {"sensor_vpd", "kPa", vapourPressureDeficit},
+	"heat_index":   {"sensor_heat_index", "C", heatIndex},
+}
+
+// Magnus formula constants , valid from -45 to 60 C
+const (
+	magnusA = 17.62
+	magnusB = 243.12
+)
+
+// saturationVapourPressure returns pressure in hPa.
+func saturationVapourPressure(temp float64) float64 {
+	return 6.112 * math.Exp(magnusA*temp/(magnusB+temp))
+}
+
+func dewPoint(temp float64, humid float64) float64 {
+	gamma := math.Log(humid/100) + magnusA*temp/(magnusB+temp)
+	return magnusB * gamma / (magnusA - gamma)
+}
+
+// absoluteHumidity returns grams of water vapour per cubic meter of air.
+func absoluteHumidity(temp float64, humid float64) float64 {
+	return 216.7 * saturationVapourPressure(temp) * humid / 100 / (273.15 + temp)
+}
+
+// vapourPressureDeficit returns difference between saturation and actual vapour pressure in kPa.
+func vapourPressureDeficit(temp float64, humid float64) float64 {
+	return saturationVapourPressure(temp) * (1 - humid/100) / 10
+}
+
+// heatIndex uses NOAA formula , it's meaningful only for warm air.
+func heatIndex(temp float64, humid float64) float64 {
+	t := temp*9/5 + 32
+	hi := 0.5 * (t + 61 + (t-68)*1.2 + humid*0.094)
+	if (hi+t)/2 >= 80 {
+		hi = -42.379 + 2.04901523*t + 10.14333127*humid - 0.22475541*t*humid - 0.00683783*t*t -
+			0.05481717*humid*humid + 0.00122874*t*t*humid + 0.00085282*t*humid*humid - 0.00000199*t*t*humid*humid
+		if humid < 13 && t >= 80 && t <= 112 {
+			hi -= (13 - humid) / 4 * math.Sqrt((17-math.Abs(t-95))/17)
+		} else if humid > 85 && t >= 80 && t <= 87 {
+			hi += (humid - 85) / 10 * (87 - t) / 5
+		}
+	}
+	return (hi - 32) * 5 / 9
+}
+
+// addDerivedMetrics adds enabled derived metrics to readings which have both temperature and humidity.
+func (mg *MiFloraAd) addDerivedMetrics(reading *DeviceReading) {
+	if len(mg.config.DerivedMetrics) == 0 {
+		return
+	}
+	var temp, humid float64
+	var hasTemp, hasHumid bool
+	for _, v := range reading.Values {
+		switch v.Service {
+		case "sensor_temp":
+			temp, hasTemp = v.Value, true
+		case "sensor_humid":
+			humid, hasHumid = v.Value, true
+		}
+	}
+	if !hasTemp || !hasHumid || humid <= 0 {
+		return
+	}
+	for _, name := range mg.config.DerivedMetrics {
+		if m, ok := derivedMetrics[name]; ok {
+			reading.Add(m.Service, math.Round(m.Calc(temp, humid)*100)/100, m.Unit)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestDerivedMetrics(t *testing.T) {
+	cases := []struct {
+		metric    string
+		temp      float64
+		humid     float64
+		expected  float64
+		tolerance float64
+	}{
+		{"dew_point", 20, 50, 9.26, 0.05},
+		{"dew_point", 25, 60, 16.69, 0.05},
+		{"dew_point", 0, 80, -3.04, 0.05},
+		{"dew_point", 30, 100, 30, 1e-9},
+		{"abs_humidity", 20, 50, 8.62, 0.05},
+		{"abs_humidity", 30, 100, 30.26, 0.05},
+		{"vpd", 25, 60, 1.26, 0.01},
+		{"vpd", 20, 50, 1.17, 0.01},
+		{"vpd", 30, 100, 0, 1e-9},
+		// NOAA heat index table , values in F converted to C
+		{"heat_index", 32.22, 70, 41.11, 0.5}, // 90 F , 106 F
+		{"heat_index", 29.44, 90, 38.89, 0.5}, // 85 F , 102 F , high humidity adjustment
+		{"heat_index", 37.78, 10, 34.44, 0.5}, // 100 F , 94 F , low humidity adjustment
+		{"heat_index", 20, 50, 19.36, 0.05},   // simple formula below 80 F
+	}
+	for _, c := range cases {
+		m := derivedMetrics[c.metric]
+		if v := m.Calc(c.temp, c.humid); math.Abs(v-c.expected) > c.tolerance {
+			t.Errorf("%s of %v C , %v %% : expected %v , got %v", c.metric, c.temp, c.humid, c.expected, v)
+		}
+	}
+}
+
+func TestAddDerivedMetrics(t *testing.T) {
+	cases := []struct {
+		name     string
+		values   map[string]float64
+		expected map[string]float64
+	}{
+		{"temperature and humidity", map[string]float64{"sensor_temp": 20, "sensor_humid": 50}, map[string]float64{"sensor_dew": 9.26, "sensor_vpd": 1.17}},
+		{"without humidity", map[string]float64{"sensor_temp": 20}, nil},
+		{"zero humidity", map[string]float64{"sensor_temp": 20, "sensor_humid": 0}, nil},
+	}
+	mg := &MiFloraAd{config: MifloraConfig{DerivedMetrics: []string{"dew_point", "vpd", "unknown"}}}
+	for _, c := range cases {
+		reading := NewDeviceReading(testDeviceAddr, "miflora")
+		for service, v := range c.values {
+			reading.Add(service, v, "")
+		}
+		mg.addDerivedMetrics(reading)
+		if len(reading.Values) != len(c.values)+len(c.expected) {
+			t.Errorf("%s : unexpected values %+v", c.name, reading.Values)
+		}
+		for service, expected := range c.expected {
+			if v, ok := readingValue(reading, service); !ok || v != expected {
+				t.Errorf("%s : expected %s %v , got %v", c.name, service, expected, v)
+			}
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/alivinco/fimpgo"
+)
+
+// ProductInfo is used in inclusion report if the device doesn't provide own information.
+type ProductInfo struct {
+	Name         string
+	Id           string
+	Manufacturer string
+}
+
+// DeviceInfo is information read from the device.
+type DeviceInfo struct {
+	Firmware     string    `json:"firmware,omitempty"`
+	Hardware     string    `json:"hardware,omitempty"`
+	Model        string    `json:"model,omitempty"`
+	Manufacturer string    `json:"manufacturer,omitempty"`
+	InfoReadAt   time.Time `json:"info_read_at"` // last attempt to read Device Information service
+}
+
+// DeviceMeta describes the device in inclusion report and outputs. Information read from the device wins over driver defaults.
+type DeviceMeta struct {
+	Name         string // product name of the driver , for instance Flower care
+	Model        string
+	Manufacturer string
+	Firmware     string
+	Hardware     string
+}
+
+// Device Information service is read again only after this period if it failed or was incomplete
+const deviceInfoRetryPeriod = 24 * time.Hour
+
+// DeviceInfoCache keeps device information in a file , so it's known right after restart.
+type DeviceInfoCache struct {
+	file  string
+	lock  sync.Mutex
+	infos map[string]DeviceInfo
+}
+
+func NewDeviceInfoCache(file string) *DeviceInfoCache {
+	c := &DeviceInfoCache{file: file, infos: map[string]DeviceInfo{}}
+	body, err := ioutil.ReadFile(file)
+	if err == nil {
+		err = json.Unmarshal(body, &c.infos)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		log.Error("<Ad> Can't load device info cache : ", err)
+	}
+	return c
+}
+
+func (c *DeviceInfoCache) Get(addr string) (DeviceInfo, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	info, ok := c.infos[addr]
+	return info, ok
+}
+
+func (c *DeviceInfoCache) Set(addr string, info DeviceInfo) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.infos[addr] = info
+	body, err := json.Marshal(c.infos)
+	if err == nil {
+		err = ioutil.WriteFile(c.file, body, 0644)
+	}
+	if err != nil {
+		log.Error("<Ad> Can't save device info cache : ", err)
+	}
+}
+
+// updateDeviceInfo stores firmware version from the reading and reads Device Information service if it's not known yet.
+// It runs in adapter job or persistent connection , so device connection doesn't collide with sensor reads.
+// Devices which are connected permanently are read after every connect , it's cheap and firmware update is usually followed by reconnect.
+func (mg *MiFloraAd) updateDeviceInfo(reading *DeviceReading, adapter string, connected bool) {
+	addr := reading.Address
+	old, _ := mg.deviceInfo.Get(addr)
+	info := old
+	if reading.Firmware != "" {
+		info.Firmware = reading.Firmware
+	}
+	incomplete := info.Model == "" || info.Manufacturer == ""
+	if connected || (old.Firmware != "" && info.Firmware != old.Firmware) || (incomplete && time.Since(info.InfoReadAt) > deviceInfoRetryPeriod) {
+		dis, err := mg.readDeviceInformation(addr, adapter)
+		if err != nil {
+			log.Infof("<Ad> Can't read device information of %s : %s", addr, err)
+		}
+		// firmware reported by driver is preferred , it's read with every poll
+		if reading.Firmware == "" && dis.Firmware != "" {
+			info.Firmware = dis.Firmware
+		}
+		if dis.Hardware != "" {
+			info.Hardware = dis.Hardware
+		}
+		if dis.Model != "" {
+			info.Model = dis.Model
+		}
+		if dis.Manufacturer != "" {
+			info.Manufacturer = dis.Manufacturer
+		}
+		info.InfoReadAt = time.Now()
+	}
+	if info == old {
+		return
+	}
+	firmwareChanged := old.Firmware != "" && info.Firmware != old.Firmware
+	mg.deviceInfo.Set(addr, info)
+	if firmwareChanged {
+		log.Infof("<Ad> Firmware of %s changed from %s to %s", addr, old.Firmware, info.Firmware)
+		mg.sendFirmwareUpdateReport(addr, old.Firmware, info.Firmware)
+		mg.SendInclusionReport(macToFimpMac(addr))
+	}
+}
+
+func (mg *MiFloraAd) deviceMeta(addr string) DeviceMeta {
+	product := mg.driverForDevice(addr).Product()
+	info, _ := mg.deviceInfo.Get(addr)
+	meta := DeviceMeta{Name: product.Name, Model: info.Model, Manufacturer: info.Manufacturer, Firmware: info.Firmware, Hardware: info.Hardware}
+	if meta.Model == "" {
+		meta.Model = product.Name
+	}
+	if meta.Manufacturer == "" {
+		meta.Manufacturer = product.Manufacturer
+	}
+	return meta
+}
+
+func (mg *MiFloraAd) readDeviceInformation(addr string, adapter string) (DeviceInfo, error) {
+	dev, err := findDevice(addr, adapter)
+	if err != nil {
+		return DeviceInfo{}, err
+	}
+	if err := connectDevice(dev); err != nil {
+		return DeviceInfo{}, err
+	}
+	defer mg.releaseGattDevice(addr, dev)
+	return readDeviceInformation(dev), nil
+}
+
+func (mg *MiFloraAd) sendFirmwareUpdateReport(addr string, oldVersion string, newVersion string) {
+	value := map[string]string{"address": macToFimpMac(addr), "old_version": oldVersion, "new_version": newVersion}
+	msg := fimpgo.NewStrMapMessage("evt.thing.firmware_update_report", "ble", value, nil, nil, nil)
+	fimpAddr, _ := fimpgo.NewAddressFromString("pt:j1/mt:evt/rt:ad/rn:ble/ad:1")
+	mg.publishEvent(fimpAddr, msg)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"time"
+)
+
+// DeviceState is runtime health of a device and its last reading.
+type DeviceState struct {
+	LastReading    *DeviceReading   `json:"last_reading,omitempty"`
+	LastSuccess    time.Time        `json:"last_success"`
+	LastAttempt    time.Time        `json:"last_attempt"`
+	LastError      string           `json:"last_error,omitempty"`
+	FailedReads    int              `json:"failed_reads"` // consecutive failed reads
+	Adapter        string           `json:"adapter"`
+	RejectedValues int              `json:"rejected_values"` // values dropped by plausibility filter
+	PlantAlarms    []string         `json:"plant_alarms,omitempty"`
+	Battery        *BatteryEstimate `json:"battery,omitempty"`
+	Info           *DeviceInfo      `json:"info,omitempty"`
+}
+
+// recordReadResult updates device state after read attempt. Last reading is stored by publishReading , after it's processed.
+func (mg *MiFloraAd) recordReadResult(addr string, reading *DeviceReading, err error) {
+	mg.lock.Lock()
+	defer mg.lock.Unlock()
+	state := mg.deviceStates[addr]
+	if state == nil {
+		state = &DeviceState{}
+		mg.deviceStates[addr] = state
+	}
+	state.LastAttempt = time.Now()
+	state.Adapter = mg.deviceAdapters[addr]
+	if err != nil {
+		state.FailedReads++
+		state.LastError = err.Error()
+	} else {
+		state.FailedReads = 0
+		state.LastError = ""
+		state.LastSuccess = reading.Time
+	}
+}
+
+// storeLastReading keeps copy of processed reading , the original is still used by outputs.
+func (mg *MiFloraAd) storeLastReading(reading *DeviceReading) {
+	last := reading.Copy()
+	mg.lock.Lock()
+	defer mg.lock.Unlock()
+	state := mg.deviceStates[reading.Address]
+	if state == nil {
+		state = &DeviceState{}
+		mg.deviceStates[reading.Address] = state
+	}
+	state.LastReading = last
+}
+
+// getDeviceState returns copy of device state.
+func (mg *MiFloraAd) getDeviceState(addr string) DeviceState {
+	mg.lock.Lock()
+	defer mg.lock.Unlock()
+	state := DeviceState{Adapter: mg.deviceAdapters[addr]}
+	if s := mg.deviceStates[addr]; s != nil {
+		state = *s
+	}
+	state.PlantAlarms = mg.plantCare.ActiveAlarms(addr)
+	if est, ok := mg.batteries.Estimate(addr); ok {
+		state.Battery = &est
+	}
+	if info, ok := mg.deviceInfo.Get(addr); ok {
+		state.Info = &info
+	}
+	return state
+}
+
+// deviceList returns copy of managed device addresses , the list can be changed at runtime.
+func (mg *MiFloraAd) deviceList() []string {
+	mg.lock.Lock()
+	defer mg.lock.Unlock()
+	return append([]string{}, mg.config.DeviceAddresses...)
+}
+
+func (mg *MiFloraAd) getDeviceConfig(addr string) DeviceConfig {
+	mg.lock.Lock()
+	defer mg.lock.Unlock()
+	return mg.config.deviceConfig(addr)
+}
+
+func (mg *MiFloraAd) isManagedDevice(addr string) bool {
+	addr = normalizeMac(addr)
+	for _, a := range mg.deviceList() {
+		if a == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// addDevice adds new device or replaces settings of existing one and saves config.
+func (mg *MiFloraAd) addDevice(conf DeviceConfig) error {
+	conf.Address = normalizeMac(conf.Address)
+	mg.lock.Lock()
+	found := false
+	for i := range mg.config.Devices {
+		if mg.config.Devices[i].Address == conf.Address {
+			mg.config.Devices[i] = conf
+			found = true
+		}
+	}
+	if !found {
+		mg.config.Devices = append(mg.config.Devices, conf)
+	}
+	managed := false
+	for _, a := range mg.config.DeviceAddresses {
+		if a == conf.Address {
+			managed = true
+		}
+	}
+	if !managed {
+		mg.config.DeviceAddresses = append(mg.config.DeviceAddresses, conf.Address)
+	}
+	mg.lock.Unlock()
+	mg.assignDevices()
+	mg.syncStream(conf.Address)
+	return mg.saveConfig()
+}
+
+// removeDevice removes device from config. Returns false if the device is not managed.
+func (mg *MiFloraAd) removeDevice(addr string) (bool, error) {
+	addr = normalizeMac(addr)
+	mg.lock.Lock()
+	found := false
+	var addresses []string
+	for _, a := range mg.config.DeviceAddresses {
+		if a == addr {
+			found = true
+			continue
+		}
+		addresses = append(addresses, a)
+	}
+	var devices []DeviceConfig
+	for _, d := range mg.config.Devices {
+		if d.Address != addr {
+			devices = append(devices, d)
+		}
+	}
+	mg.config.DeviceAddresses = addresses
+	mg.config.Devices = devices
+	delete(mg.deviceStates, addr)
+	mg.lock.Unlock()
+	mg.stopStream(addr)
+	if !found {
+		return false, nil
+	}
+	mg.assignDevices()
+	return true, mg.saveConfig()
+}
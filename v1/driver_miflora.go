@@ -0,0 +1,98 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/barnybug/miflora"
+)
+
+const mifloraServiceUUID = "0000fe95-0000-1000-8000-00805f9b34fb"
+
+// MifloraDriver reads Xiaomi Mi Flora (Flower care) plant sensors.
+type MifloraDriver struct{}
+
+func (d *MifloraDriver) Name() string {
+	return "miflora"
+}
+
+func (d *MifloraDriver) Match(name string, uuids []string) bool {
+	if name == "Flower care" || name == "Flower mate" {
+		return true
+	}
+	for _, uuid := range uuids {
+		if strings.ToLower(uuid) == mifloraServiceUUID && strings.HasPrefix(name, "Flower") {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *MifloraDriver) Product() ProductInfo {
+	return ProductInfo{Name: "Flower care", Id: "flower_care", Manufacturer: "mi"}
+}
+
+func (d *MifloraDriver) Services() []ServiceDescriptor {
+	return []ServiceDescriptor{
+		sensorService("sensor_temp", "C"),
+		sensorService("sensor_lumin", "Lux"),
+		sensorService("sensor_moist", "%"),
+		sensorService("sensor_conduct", "µS/cm"),
+		batteryService(),
+	}
+}
+
+func (d *MifloraDriver) Read(addr string, opts ReadOptions) (*DeviceReading, error) {
+	log.Info("Reading miflora...")
+	dev := miflora.NewMiflora(addr, opts.Adapter)
+
+	reading := NewDeviceReading(addr, d.Name())
+	err := d.readFirmware(dev, opts, reading)
+
+	var sensors miflora.Sensors
+	for i := 0; i < opts.RetryCount; i++ {
+		if i > 0 {
+			metricReadRetries.WithLabelValues(opts.Adapter).Inc()
+		}
+		started := time.Now()
+		sensors, err = dev.ReadSensors()
+		metricGattLatency.WithLabelValues(opts.Adapter, "read_sensors").Observe(time.Since(started).Seconds())
+		if err == nil {
+			break
+		} else {
+			log.Infof("Failed reading sensors,retrying")
+		}
+		time.Sleep(1 * time.Second)
+	}
+	if err == nil {
+		log.Infof("Reporting sensors: %+v\n", sensors)
+		// implausible values are dropped later by plausibility filter
+		reading.Add("sensor_temp", sensors.Temperature, "C")
+		reading.Add("sensor_lumin", float64(sensors.Light), "Lux")
+		reading.Add("sensor_moist", float64(sensors.Moisture), "%")
+		reading.Add("sensor_conduct", float64(sensors.Conductivity), "µS/cm")
+	}
+	return reading, err
+}
+
+// ReadBattery reads only firmware characteristic , which contains battery level. Sensors aren't switched to realtime mode.
+func (d *MifloraDriver) ReadBattery(addr string, opts ReadOptions) (*DeviceReading, error) {
+	reading := NewDeviceReading(addr, d.Name())
+	err := d.readFirmware(miflora.NewMiflora(addr, opts.Adapter), opts, reading)
+	return reading, err
+}
+
+// readFirmware adds battery level and firmware version to the reading.
+func (d *MifloraDriver) readFirmware(dev *miflora.Miflora, opts ReadOptions, reading *DeviceReading) error {
+	started := time.Now()
+	firmware, err := dev.ReadFirmware()
+	metricGattLatency.WithLabelValues(opts.Adapter, "read_firmware").Observe(time.Since(started).Seconds())
+	if err != nil {
+		return err
+	}
+	log.Infof("Firmware: %+v\n", firmware)
+	reading.SetBattery(int(firmware.Battery))
+	reading.Firmware = firmware.Version
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// ReadOptions are passed to driver on every read.
+type ReadOptions struct {
+	Adapter    string
+	RetryCount int
+}
+
+// Driver knows how to recognize and read one type of BLE device.
+type Driver interface {
+	Name() string
+	// Match returns true if discovered device , identified by advertised name and service UUIDs , is handled by the driver.
+	Match(name string, uuids []string) bool
+	// Read connects to the device and reads all values.
+	Read(addr string, opts ReadOptions) (*DeviceReading, error)
+	// Product is used in inclusion report when the device doesn't provide own information.
+	Product() ProductInfo
+	// Services declares FIMP services of the device , every value returned by Read must belong to one of them.
+	Services() []ServiceDescriptor
+}
+
+const defaultDriver = "miflora"
+
+var drivers = map[string]Driver{}
+
+func registerDriver(driver Driver) {
+	drivers[driver.Name()] = driver
+}
+
+func init() {
+	registerDriver(&MifloraDriver{})
+}
+
+// matchDriver returns name of the first driver which recognizes the device , or empty string.
+func matchDriver(name string, uuids []string) string {
+	var names []string
+	for driverName := range drivers {
+		names = append(names, driverName)
+	}
+	sort.Strings(names)
+	for _, driverName := range names {
+		if drivers[driverName].Match(name, uuids) {
+			return driverName
+		}
+	}
+	return ""
+}
+
+func driverNames() string {
+	var names []string
+	for name := range drivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// driverForDevice returns driver configured for the device , Mi Flora is used by default.
+func (mg *MiFloraAd) driverForDevice(addr string) Driver {
+	name := mg.getDeviceConfig(addr).Driver
+	if name == "" {
+		name = defaultDriver
+	}
+	if driver, ok := drivers[name]; ok {
+		return driver
+	}
+	return drivers[defaultDriver]
+}
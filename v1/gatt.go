@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/godbus/dbus"
+	"github.com/muka/go-bluetooth/api"
+	"github.com/muka/go-bluetooth/bluez/profile"
+)
+
+// discovery is started if device isn't known to BlueZ yet
+const gattDiscoveryDuration = 5 * time.Second
+
+const gattConnectTimeout = 15 * time.Second
+
+// fullUUID converts 16 bit UUID to full 128 bit form , BlueZ reports only full UUIDs.
+func fullUUID(uuid string) string {
+	uuid = strings.ToLower(uuid)
+	if len(uuid) == 4 {
+		return "0000" + uuid + "-0000-1000-8000-00805f9b34fb"
+	}
+	return uuid
+}
+
+func lookupDevice(addr string, adapter string) (*api.Device, error) {
+	devices, err := api.GetDevices()
+	if err != nil {
+		return nil, err
+	}
+	for i := range devices {
+		props, err := devices[i].GetProperties()
+		if err != nil {
+			continue
+		}
+		if strings.EqualFold(props.Address, addr) && (adapter == "" || path.Base(string(props.Adapter)) == adapter) {
+			return &devices[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// findDevice returns BlueZ device on the adapter , short discovery is run if the device wasn't seen yet.
+func findDevice(addr string, adapter string) (*api.Device, error) {
+	dev, err := lookupDevice(addr, adapter)
+	if dev != nil || err != nil {
+		return dev, err
+	}
+	if err := api.StartDiscoveryOn(adapter); err != nil {
+		return nil, err
+	}
+	time.Sleep(gattDiscoveryDuration)
+	api.StopDiscoveryOn(adapter)
+	dev, err = lookupDevice(addr, adapter)
+	if dev == nil && err == nil {
+		err = fmt.Errorf("device %s not found on %s", addr, adapter)
+	}
+	return dev, err
+}
+
+// connectDevice connects to the device and waits until GATT services are resolved.
+func connectDevice(dev *api.Device) error {
+	if !dev.IsConnected() {
+		if err := dev.Connect(); err != nil {
+			return err
+		}
+	}
+	deadline := time.Now().Add(gattConnectTimeout)
+	for time.Now().Before(deadline) {
+		props, err := dev.GetProperties()
+		if err != nil {
+			return err
+		}
+		if props.ServicesResolved {
+			return nil
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	return errors.New("timeout while resolving GATT services")
+}
+
+func getCharacteristic(dev *api.Device, uuid string) (*profile.GattCharacteristic1, error) {
+	char, err := dev.GetCharByUUID(fullUUID(uuid))
+	if err != nil {
+		return nil, err
+	}
+	if char == nil {
+		return nil, fmt.Errorf("characteristic %s not found", uuid)
+	}
+	return char, nil
+}
+
+func readCharacteristic(dev *api.Device, uuid string) ([]byte, error) {
+	char, err := getCharacteristic(dev, uuid)
+	if err != nil {
+		return nil, err
+	}
+	return char.ReadValue(map[string]dbus.Variant{})
+}
+
+func writeCharacteristic(dev *api.Device, uuid string, value []byte, withResponse bool) error {
+	char, err := getCharacteristic(dev, uuid)
+	if err != nil {
+		return err
+	}
+	writeType := "command"
+	if withResponse {
+		writeType = "request"
+	}
+	return char.WriteValue(value, map[string]dbus.Variant{"type": dbus.MakeVariant(writeType)})
+}
+
+// notificationValue extracts new characteristic value from PropertiesChanged signal.
+func notificationValue(signal *dbus.Signal) ([]byte, bool) {
+	if signal == nil || len(signal.Body) < 2 {
+		return nil, false
+	}
+	changed, ok := signal.Body[1].(map[string]dbus.Variant)
+	if !ok {
+		return nil, false
+	}
+	v, ok := changed["Value"]
+	if !ok {
+		return nil, false
+	}
+	value, ok := v.Value().([]byte)
+	return value, ok
+}
+
+// waitNotification subscribes to the characteristic and returns the first notified value.
+func waitNotification(dev *api.Device, uuid string, timeout time.Duration) ([]byte, error) {
+	char, err := getCharacteristic(dev, uuid)
+	if err != nil {
+		return nil, err
+	}
+	signals, err := char.Register()
+	if err != nil {
+		return nil, err
+	}
+	defer char.Unregister()
+	if err := char.StartNotify(); err != nil {
+		return nil, err
+	}
+	defer char.StopNotify()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case signal, ok := <-signals:
+			if !ok {
+				return nil, errors.New("notification channel closed")
+			}
+			if value, ok := notificationValue(signal); ok {
+				return value, nil
+			}
+		case <-timer.C:
+			return nil, fmt.Errorf("no notification from %s within %s", uuid, timeout)
+		}
+	}
+}
+
+// readDeviceInformation reads standard Device Information service of connected device. Characteristics which the device doesn't have are left empty.
+func readDeviceInformation(dev *api.Device) DeviceInfo {
+	var info DeviceInfo
+	fields := map[string]*string{
+		"2a26": &info.Firmware,
+		"2a27": &info.Hardware,
+		"2a24": &info.Model,
+		"2a29": &info.Manufacturer,
+	}
+	for uuid, field := range fields {
+		value, err := readCharacteristic(dev, uuid)
+		if err != nil {
+			continue
+		}
+		*field = strings.TrimRight(string(value), "\x00 ")
+	}
+	return info
+}
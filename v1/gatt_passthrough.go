@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/alivinco/fimpgo"
+	"github.com/muka/go-bluetooth/api"
+)
+
+// gattService is the FIMP service of raw GATT access , commands are sent to pt:j1/mt:cmd/rt:dev/rn:ble/ad:1/sv:gatt/ad:<mac>
+const gattService = "gatt"
+
+const (
+	defaultGattSubscribeDuration = 60 * time.Second
+	maxGattSubscribeDuration     = 10 * time.Minute
+)
+
+type gattCharacteristicInfo struct {
+	UUID  string   `json:"uuid"`
+	Flags []string `json:"flags"`
+}
+
+type gattServiceInfo struct {
+	UUID            string                   `json:"uuid"`
+	Characteristics []gattCharacteristicInfo `json:"characteristics"`
+}
+
+func encodeGattValue(value []byte, encoding string) string {
+	if encoding == "base64" {
+		return base64.StdEncoding.EncodeToString(value)
+	}
+	return hex.EncodeToString(value)
+}
+
+func decodeGattValue(value string, encoding string) ([]byte, error) {
+	if encoding == "base64" {
+		return base64.StdEncoding.DecodeString(value)
+	}
+	return hex.DecodeString(strings.Replace(value, " ", "", -1))
+}
+
+// onGattCommand serves cmd.gatt.* commands. Operations run in job queue of the adapter , result or error is sent as evt.gatt.* report.
+func (mg *MiFloraAd) onGattCommand(addr string, iotMsg *fimpgo.FimpMessage) {
+	var params map[string]string
+	if iotMsg.ValueType == fimpgo.VTypeStrMap {
+		params, _ = iotMsg.GetStrMapValue()
+	}
+	if params == nil {
+		params = map[string]string{}
+	}
+	switch iotMsg.Type {
+	case "cmd.gatt.get_services":
+		mg.enqueueGattJob(addr, "evt.gatt.services_report", "", iotMsg, func() { mg.gattGetServices(addr, iotMsg) })
+	case "cmd.gatt.read":
+		mg.enqueueGattJob(addr, "evt.gatt.read_report", params["char"], iotMsg, func() { mg.gattRead(addr, params, iotMsg) })
+	case "cmd.gatt.write":
+		mg.enqueueGattJob(addr, "evt.gatt.write_report", params["char"], iotMsg, func() { mg.gattWrite(addr, params, iotMsg) })
+	case "cmd.gatt.subscribe":
+		mg.enqueueGattJob(addr, "evt.gatt.notify_report", params["char"], iotMsg, func() {
+			ready := make(chan struct{})
+			go mg.gattSubscribe(addr, params, iotMsg, ready)
+			<-ready
+		})
+	case "cmd.gatt.unsubscribe":
+		mg.gattUnsubscribe(addr, params["char"], iotMsg)
+	}
+}
+
+func (mg *MiFloraAd) enqueueGattJob(addr string, msgType string, char string, request *fimpgo.FimpMessage, run func()) {
+	mg.enqueueAdapterJob(adapterJob{addr: addr, run: run, fail: func(err error) {
+		mg.sendGattError(addr, msgType, char, err, request)
+	}})
+}
+
+// connectGattDevice connects to the device over the adapter the device is assigned to.
+func (mg *MiFloraAd) connectGattDevice(addr string) (*api.Device, error) {
+	dev, err := findDevice(addr, mg.adapterForDevice(addr).Name)
+	if err != nil {
+		return nil, err
+	}
+	return dev, connectDevice(dev)
+}
+
+// releaseGattDevice disconnects the device , unless it's kept connected by persistent stream.
+func (mg *MiFloraAd) releaseGattDevice(addr string, dev *api.Device) {
+	if !mg.isStreamingDevice(addr) {
+		dev.Disconnect()
+	}
+}
+
+func (mg *MiFloraAd) gattGetServices(addr string, request *fimpgo.FimpMessage) {
+	dev, err := mg.connectGattDevice(addr)
+	if err != nil {
+		mg.sendGattError(addr, "evt.gatt.services_report", "", err, request)
+		return
+	}
+	defer mg.releaseGattDevice(addr, dev)
+	list, err := dev.GetAllServicesAndUUID()
+	if err != nil {
+		mg.sendGattError(addr, "evt.gatt.services_report", "", err, request)
+		return
+	}
+	// entries are in service:characteristic form
+	var services []gattServiceInfo
+	index := map[string]int{}
+	for _, entry := range list {
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		i, ok := index[parts[0]]
+		if !ok {
+			i = len(services)
+			index[parts[0]] = i
+			services = append(services, gattServiceInfo{UUID: parts[0]})
+		}
+		info := gattCharacteristicInfo{UUID: parts[1]}
+		if char, err := dev.GetCharByUUID(parts[1]); err == nil && char != nil && char.Properties != nil {
+			info.Flags = char.Properties.Flags
+		}
+		services[i].Characteristics = append(services[i].Characteristics, info)
+	}
+	msg := fimpgo.NewMessage("evt.gatt.services_report", gattService, fimpgo.VTypeObject, services, nil, nil, request)
+	mg.publishGattReport(addr, msg)
+}
+
+func (mg *MiFloraAd) gattRead(addr string, params map[string]string, request *fimpgo.FimpMessage) {
+	char := params["char"]
+	dev, err := mg.connectGattDevice(addr)
+	if err == nil {
+		defer mg.releaseGattDevice(addr, dev)
+		var value []byte
+		value, err = readCharacteristic(dev, char)
+		if err == nil {
+			report := map[string]string{"char": char, "value": encodeGattValue(value, params["encoding"]), "encoding": gattEncoding(params)}
+			mg.publishGattReport(addr, fimpgo.NewStrMapMessage("evt.gatt.read_report", gattService, report, nil, nil, request))
+			return
+		}
+	}
+	mg.sendGattError(addr, "evt.gatt.read_report", char, err, request)
+}
+
+func (mg *MiFloraAd) gattWrite(addr string, params map[string]string, request *fimpgo.FimpMessage) {
+	char := params["char"]
+	value, err := decodeGattValue(params["value"], params["encoding"])
+	if err != nil {
+		mg.sendGattError(addr, "evt.gatt.write_report", char, err, request)
+		return
+	}
+	dev, err := mg.connectGattDevice(addr)
+	if err == nil {
+		defer mg.releaseGattDevice(addr, dev)
+		err = writeCharacteristic(dev, char, value, params["response"] == "true")
+		if err == nil {
+			report := map[string]string{"char": char, "status": "ok"}
+			mg.publishGattReport(addr, fimpgo.NewStrMapMessage("evt.gatt.write_report", gattService, report, nil, nil, request))
+			return
+		}
+	}
+	mg.sendGattError(addr, "evt.gatt.write_report", char, err, request)
+}
+
+// gattSubscribe forwards notifications of the characteristic as evt.gatt.notify_report until duration expires or unsubscribe command.
+// ready is closed once subscription is set up or failed , so the adapter job doesn't wait for whole subscription.
+func (mg *MiFloraAd) gattSubscribe(addr string, params map[string]string, request *fimpgo.FimpMessage, ready chan struct{}) {
+	subscribed := false
+	defer func() {
+		if !subscribed {
+			close(ready)
+		}
+	}()
+	char := params["char"]
+	duration := defaultGattSubscribeDuration
+	if s, err := strconv.Atoi(params["duration"]); err == nil && s > 0 {
+		duration = time.Duration(s) * time.Second
+	}
+	if duration > maxGattSubscribeDuration {
+		duration = maxGattSubscribeDuration
+	}
+	key := addr + "|" + fullUUID(char)
+	stop := make(chan struct{})
+	mg.lock.Lock()
+	if _, ok := mg.gattSubscriptions[key]; ok {
+		mg.lock.Unlock()
+		mg.sendGattError(addr, "evt.gatt.notify_report", char, errors.New("already subscribed"), request)
+		return
+	}
+	mg.gattSubscriptions[key] = stop
+	mg.lock.Unlock()
+	defer func() {
+		mg.lock.Lock()
+		if mg.gattSubscriptions[key] == stop {
+			delete(mg.gattSubscriptions, key)
+		}
+		mg.lock.Unlock()
+	}()
+	// subscription holds the connection like persistent stream , so it needs a connection slot of the adapter.
+	// Streaming device is already connected and it's slot is used.
+	if !mg.isStreamingDevice(addr) {
+		slots := mg.connectionSlots(mg.adapterForDevice(addr).Name)
+		select {
+		case slots <- struct{}{}:
+			defer func() { <-slots }()
+		default:
+			mg.sendGattError(addr, "evt.gatt.notify_report", char, errors.New("all connections of the adapter are in use"), request)
+			return
+		}
+	}
+
+	dev, err := mg.connectGattDevice(addr)
+	if err != nil {
+		mg.sendGattError(addr, "evt.gatt.notify_report", char, err, request)
+		return
+	}
+	defer mg.releaseGattDevice(addr, dev)
+	c, err := getCharacteristic(dev, char)
+	if err != nil {
+		mg.sendGattError(addr, "evt.gatt.notify_report", char, err, request)
+		return
+	}
+	signals, err := c.Register()
+	if err != nil {
+		mg.sendGattError(addr, "evt.gatt.notify_report", char, err, request)
+		return
+	}
+	defer c.Unregister()
+	if err := c.StartNotify(); err != nil {
+		mg.sendGattError(addr, "evt.gatt.notify_report", char, err, request)
+		return
+	}
+	defer c.StopNotify()
+	subscribed = true
+	close(ready)
+	log.Infof("<Ad> Forwarding notifications of %s from %s for %s", char, addr, duration)
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	for {
+		select {
+		case signal, ok := <-signals:
+			if !ok {
+				mg.sendGattError(addr, "evt.gatt.notify_report", char, errors.New("device disconnected"), request)
+				return
+			}
+			if value, ok := notificationValue(signal); ok {
+				report := map[string]string{"char": char, "value": encodeGattValue(value, params["encoding"]), "encoding": gattEncoding(params)}
+				mg.publishGattReport(addr, fimpgo.NewStrMapMessage("evt.gatt.notify_report", gattService, report, nil, nil, request))
+			}
+		case <-timer.C:
+			return
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (mg *MiFloraAd) gattUnsubscribe(addr string, char string, request *fimpgo.FimpMessage) {
+	mg.lock.Lock()
+	key := addr + "|" + fullUUID(char)
+	stop, ok := mg.gattSubscriptions[key]
+	if ok {
+		close(stop)
+		delete(mg.gattSubscriptions, key)
+	}
+	mg.lock.Unlock()
+	if !ok {
+		mg.sendGattError(addr, "evt.gatt.notify_report", char, errors.New("not subscribed"), request)
+		return
+	}
+	report := map[string]string{"char": char, "status": "unsubscribed"}
+	mg.publishGattReport(addr, fimpgo.NewStrMapMessage("evt.gatt.notify_report", gattService, report, nil, nil, request))
+}
+
+func gattEncoding(params map[string]string) string {
+	if params["encoding"] == "base64" {
+		return "base64"
+	}
+	return "hex"
+}
+
+func (mg *MiFloraAd) sendGattError(addr string, msgType string, char string, err error, request *fimpgo.FimpMessage) {
+	log.Errorf("<Ad> GATT operation on %s failed : %s", addr, err)
+	report := map[string]string{"char": char, "status": "error", "error": err.Error()}
+	mg.publishGattReport(addr, fimpgo.NewStrMapMessage(msgType, gattService, report, nil, nil, request))
+}
+
+func (mg *MiFloraAd) publishGattReport(addr string, msg *fimpgo.FimpMessage) {
+	fimpAddr := deviceEventAddress(gattService, addr)
+	mg.checkDeclaredEvent(fimpAddr, msg)
+	mg.msgTransport.Publish(fimpAddr, msg)
+}
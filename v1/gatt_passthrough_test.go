@@ -0,0 +1,45 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/alivinco/fimpgo"
+)
+
+func TestGattSubscribeNeedsConnectionSlot(t *testing.T) {
+	mg, transport := newTestAdapter(t, MifloraConfig{DeviceAddresses: []string{testDeviceAddr}, MaxConnectionsPerAdapter: 1}, nil)
+	defer os.RemoveAll(filepath.Dir(mg.configPath))
+	mg.adapterNames = []string{"hci0"}
+	mg.adapters = map[string]*HciAdapter{"hci0": NewHciAdapter("hci0")}
+	mg.deviceAdapters = map[string]string{}
+	mg.adapterConnections = map[string]chan struct{}{}
+	mg.gattSubscriptions = map[string]chan struct{}{}
+	// the only connection of the adapter is held by other device
+	mg.connectionSlots("hci0") <- struct{}{}
+
+	params := map[string]string{"char": "1a01"}
+	request := fimpgo.NewStrMapMessage("cmd.gatt.subscribe", gattService, params, nil, nil, nil)
+	ready := make(chan struct{})
+	mg.gattSubscribe(testDeviceAddr, params, request, ready)
+	select {
+	case <-ready:
+	default:
+		t.Fatal("ready wasn't closed")
+	}
+	events := transport.take()
+	if len(events) != 1 || events[0].msg.Type != "evt.gatt.notify_report" {
+		t.Fatalf("expected notify_report error , got %d events", len(events))
+	}
+	if report, _ := events[0].msg.GetStrMapValue(); report["status"] != "error" || !strings.Contains(report["error"], "connections") {
+		t.Errorf("unexpected report %v", report)
+	}
+	if len(mg.gattSubscriptions) != 0 {
+		t.Error("refused subscription is registered")
+	}
+	if len(mg.connectionSlots("hci0")) != 1 {
+		t.Error("slot of other connection was released")
+	}
+}
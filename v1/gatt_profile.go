@@ -0,0 +1,451 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/muka/go-bluetooth/api"
+	"gopkg.in/yaml.v2"
+)
+
+// GattProfile describes simple BLE sensor , profiles are executed by generic driver.
+type GattProfile struct {
+	Name          string         `json:"name" yaml:"name"` // used as driver name
+	Match         ProfileMatch   `json:"match" yaml:"match"`
+	Setup         []ProfileWrite `json:"setup" yaml:"setup"` // writes done after connect , for instance to enable measurement
+	Values        []ProfileValue `json:"values" yaml:"values"`
+	NotifyTimeout int            `json:"notify_timeout" yaml:"notify_timeout"` // seconds , 30 by default
+	ProductName   string         `json:"product_name" yaml:"product_name"`     // used in inclusion report if the device has no Device Information service
+	Manufacturer  string         `json:"manufacturer" yaml:"manufacturer"`
+}
+
+type ProfileMatch struct {
+	Names        []string `json:"names" yaml:"names"` // advertised names
+	NamePrefix   string   `json:"name_prefix" yaml:"name_prefix"`
+	ServiceUUIDs []string `json:"service_uuids" yaml:"service_uuids"` // any of advertised service UUIDs
+}
+
+type ProfileWrite struct {
+	Characteristic string `json:"characteristic" yaml:"characteristic"`
+	Value          string `json:"value" yaml:"value"` // hex
+	WithResponse   bool   `json:"with_response" yaml:"with_response"`
+}
+
+// ProfileValue describes where value is in characteristic payload and how it's reported.
+type ProfileValue struct {
+	Characteristic string  `json:"characteristic" yaml:"characteristic"`
+	Notify         bool    `json:"notify" yaml:"notify"` // value is delivered by notification instead of read
+	Offset         int     `json:"offset" yaml:"offset"`
+	Type           string  `json:"type" yaml:"type"`             // uint8 , int8 , uint16 , int16 , uint32 , int32 , float32
+	Endianness     string  `json:"endianness" yaml:"endianness"` // little (default) or big
+	Scale          float64 `json:"scale" yaml:"scale"`           // 1 by default
+	Add            float64 `json:"add" yaml:"add"`               // added after scaling
+	Service        string  `json:"service" yaml:"service"`       // FIMP service , battery is reported as battery level
+	Unit           string  `json:"unit" yaml:"unit"`
+}
+
+var profileTypeSizes = map[string]int{"uint8": 1, "int8": 1, "uint16": 2, "int16": 2, "uint32": 4, "int32": 4, "float32": 4}
+
+func (v ProfileValue) Decode(data []byte) (float64, error) {
+	size, ok := profileTypeSizes[v.Type]
+	if !ok {
+		return 0, fmt.Errorf("unknown type %s", v.Type)
+	}
+	if v.Offset < 0 || v.Offset+size > len(data) {
+		return 0, fmt.Errorf("payload of %d bytes is too short for %s at offset %d", len(data), v.Type, v.Offset)
+	}
+	var order binary.ByteOrder = binary.LittleEndian
+	if v.Endianness == "big" {
+		order = binary.BigEndian
+	}
+	b := data[v.Offset : v.Offset+size]
+	var raw float64
+	switch v.Type {
+	case "uint8":
+		raw = float64(b[0])
+	case "int8":
+		raw = float64(int8(b[0]))
+	case "uint16":
+		raw = float64(order.Uint16(b))
+	case "int16":
+		raw = float64(int16(order.Uint16(b)))
+	case "uint32":
+		raw = float64(order.Uint32(b))
+	case "int32":
+		raw = float64(int32(order.Uint32(b)))
+	case "float32":
+		raw = float64(math.Float32frombits(order.Uint32(b)))
+	}
+	scale := v.Scale
+	if scale == 0 {
+		scale = 1
+	}
+	return raw*scale + v.Add, nil
+}
+
+func (p *GattProfile) Validate() error {
+	if p.Name == "" {
+		return errors.New("name is empty")
+	}
+	if len(p.Values) == 0 {
+		return errors.New("no values")
+	}
+	for _, w := range p.Setup {
+		if w.Characteristic == "" {
+			return errors.New("setup write without characteristic")
+		}
+		if _, err := hex.DecodeString(w.Value); err != nil {
+			return fmt.Errorf("setup value %s is not hex", w.Value)
+		}
+	}
+	for _, v := range p.Values {
+		if v.Characteristic == "" || v.Service == "" {
+			return errors.New("value needs characteristic and service")
+		}
+		if _, ok := profileTypeSizes[v.Type]; !ok {
+			return fmt.Errorf("value %s has unknown type %s", v.Service, v.Type)
+		}
+		if v.Endianness != "" && v.Endianness != "little" && v.Endianness != "big" {
+			return fmt.Errorf("value %s has unknown endianness %s", v.Service, v.Endianness)
+		}
+	}
+	return nil
+}
+
+// LoadGattProfile reads profile from JSON or YAML file.
+func LoadGattProfile(file string) (*GattProfile, error) {
+	body, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	profile := &GattProfile{}
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(body, profile)
+	default:
+		err = json.Unmarshal(body, profile)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := profile.Validate(); err != nil {
+		return nil, err
+	}
+	return profile, nil
+}
+
+// gattProfileDir returns profile directory , relative path is resolved against config file directory.
+func gattProfileDir(configPath string, config MifloraConfig) string {
+	return configRelativePath(configPath, config.GattProfileDir)
+}
+
+// configRelativePath resolves path from config against config file directory , so it doesn't depend on working directory.
+func configRelativePath(configPath string, path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(filepath.Dir(configPath), path)
+}
+
+// loadGattProfiles registers a driver for every profile in the directory.
+func loadGattProfiles(dir string) error {
+	if dir == "" {
+		return nil
+	}
+	var files []string
+	for _, pattern := range []string{"*.json", "*.yaml", "*.yml"} {
+		matches, _ := filepath.Glob(filepath.Join(dir, pattern))
+		files = append(files, matches...)
+	}
+	var problems []string
+	for _, file := range files {
+		profile, err := LoadGattProfile(file)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s : %s", file, err))
+			continue
+		}
+		if d, ok := drivers[profile.Name]; ok {
+			if _, isProfile := d.(*ProfileDriver); !isProfile {
+				problems = append(problems, fmt.Sprintf("%s : name %s is used by built-in driver", file, profile.Name))
+				continue
+			}
+		}
+		registerDriver(&ProfileDriver{profile: profile})
+		log.Infof("<Ad> Loaded device profile %s from %s", profile.Name, file)
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, " ; "))
+	}
+	return nil
+}
+
+// ProfileDriver reads devices described by GATT profile.
+type ProfileDriver struct {
+	profile *GattProfile
+}
+
+func (d *ProfileDriver) Name() string {
+	return d.profile.Name
+}
+
+func (d *ProfileDriver) Match(name string, uuids []string) bool {
+	m := d.profile.Match
+	for _, n := range m.Names {
+		if n == name {
+			return true
+		}
+	}
+	if m.NamePrefix != "" && strings.HasPrefix(name, m.NamePrefix) {
+		return true
+	}
+	for _, want := range m.ServiceUUIDs {
+		for _, uuid := range uuids {
+			if fullUUID(want) == strings.ToLower(uuid) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (d *ProfileDriver) Product() ProductInfo {
+	name := d.profile.ProductName
+	if name == "" {
+		name = d.profile.Name
+	}
+	return ProductInfo{Name: name, Id: d.profile.Name, Manufacturer: d.profile.Manufacturer}
+}
+
+func (d *ProfileDriver) Services() []ServiceDescriptor {
+	var services []ServiceDescriptor
+	seen := map[string]bool{}
+	for _, v := range d.profile.Values {
+		if seen[v.Service] {
+			continue
+		}
+		seen[v.Service] = true
+		if v.Service == "battery" {
+			services = append(services, batteryService())
+		} else {
+			services = append(services, sensorService(v.Service, v.Unit))
+		}
+	}
+	return services
+}
+
+func (d *ProfileDriver) Read(addr string, opts ReadOptions) (*DeviceReading, error) {
+	reading := NewDeviceReading(addr, d.Name())
+	var err error
+	for i := 0; i < opts.RetryCount; i++ {
+		if i > 0 {
+			metricReadRetries.WithLabelValues(opts.Adapter).Inc()
+			time.Sleep(1 * time.Second)
+		}
+		started := time.Now()
+		err = d.readOnce(addr, opts.Adapter, reading)
+		metricGattLatency.WithLabelValues(opts.Adapter, "read_profile").Observe(time.Since(started).Seconds())
+		if err == nil {
+			break
+		}
+		log.Infof("<Ad> Failed reading %s with profile %s : %s", addr, d.Name(), err)
+	}
+	return reading, err
+}
+
+func (d *ProfileDriver) readOnce(addr string, adapter string, reading *DeviceReading) error {
+	dev, err := findDevice(addr, adapter)
+	if err != nil {
+		return err
+	}
+	if err := connectDevice(dev); err != nil {
+		return err
+	}
+	defer dev.Disconnect()
+	if err := d.setup(dev); err != nil {
+		return err
+	}
+	payloads, err := d.readPayloads(dev)
+	if err != nil {
+		return err
+	}
+	// reading is filled only if the whole payload was decoded
+	decoded, err := d.decode(addr, payloads)
+	if err != nil {
+		return err
+	}
+	*reading = *decoded
+	return nil
+}
+
+func (d *ProfileDriver) setup(dev *api.Device) error {
+	for _, w := range d.profile.Setup {
+		value, _ := hex.DecodeString(w.Value)
+		if err := writeCharacteristic(dev, w.Characteristic, value, w.WithResponse); err != nil {
+			return fmt.Errorf("setup write to %s failed : %s", w.Characteristic, err)
+		}
+	}
+	return nil
+}
+
+// decode converts payloads to reading. Only values of characteristics present in payloads are decoded.
+func (d *ProfileDriver) decode(addr string, payloads map[string][]byte) (*DeviceReading, error) {
+	reading := NewDeviceReading(addr, d.Name())
+	for _, v := range d.profile.Values {
+		data, ok := payloads[fullUUID(v.Characteristic)]
+		if !ok {
+			continue
+		}
+		value, err := v.Decode(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s : %s", v.Service, err)
+		}
+		if v.Service == "battery" {
+			reading.SetBattery(int(value))
+		} else {
+			reading.Add(v.Service, value, v.Unit)
+		}
+	}
+	return reading, nil
+}
+
+// readPayloads reads every characteristic used by profile values once.
+func (d *ProfileDriver) readPayloads(dev *api.Device) (map[string][]byte, error) {
+	timeout := time.Duration(d.profile.NotifyTimeout) * time.Second
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	payloads := map[string][]byte{}
+	for _, v := range d.profile.Values {
+		uuid := fullUUID(v.Characteristic)
+		if _, ok := payloads[uuid]; ok {
+			continue
+		}
+		var data []byte
+		var err error
+		if v.Notify {
+			data, err = waitNotification(dev, uuid, timeout)
+		} else {
+			data, err = readCharacteristic(dev, uuid)
+		}
+		if err != nil {
+			return nil, err
+		}
+		payloads[uuid] = data
+	}
+	return payloads, nil
+}
+
+// CanStream returns true if the profile has values delivered by notifications.
+func (d *ProfileDriver) CanStream() bool {
+	for _, v := range d.profile.Values {
+		if v.Notify {
+			return true
+		}
+	}
+	return false
+}
+
+type profileNotification struct {
+	uuid string
+	data []byte
+}
+
+// Stream keeps connection to the device and sends reading for every notification. Values which are not notified are read once after connect.
+func (d *ProfileDriver) Stream(addr string, opts ReadOptions, readings chan<- *DeviceReading, stop <-chan struct{}) error {
+	dev, err := findDevice(addr, opts.Adapter)
+	if err != nil {
+		return err
+	}
+	if err := connectDevice(dev); err != nil {
+		return err
+	}
+	defer dev.Disconnect()
+	if err := d.setup(dev); err != nil {
+		return err
+	}
+
+	payloads := map[string][]byte{}
+	notified := map[string]bool{}
+	for _, v := range d.profile.Values {
+		uuid := fullUUID(v.Characteristic)
+		if v.Notify {
+			notified[uuid] = true
+		}
+	}
+	for _, v := range d.profile.Values {
+		uuid := fullUUID(v.Characteristic)
+		if _, ok := payloads[uuid]; ok || notified[uuid] {
+			continue
+		}
+		if payloads[uuid], err = readCharacteristic(dev, uuid); err != nil {
+			return err
+		}
+	}
+	if len(payloads) > 0 {
+		reading, err := d.decode(addr, payloads)
+		if err != nil {
+			return err
+		}
+		readings <- reading
+	}
+
+	notifications := make(chan profileNotification)
+	done := make(chan struct{})
+	defer close(done)
+	for uuid := range notified {
+		char, err := getCharacteristic(dev, uuid)
+		if err != nil {
+			return err
+		}
+		signals, err := char.Register()
+		if err != nil {
+			return err
+		}
+		defer char.Unregister()
+		if err := char.StartNotify(); err != nil {
+			return err
+		}
+		defer char.StopNotify()
+		go func(uuid string) {
+			for signal := range signals {
+				if data, ok := notificationValue(signal); ok {
+					select {
+					case notifications <- profileNotification{uuid, data}:
+					case <-done:
+						return
+					}
+				}
+			}
+		}(uuid)
+	}
+
+	// BlueZ doesn't close signal channels on disconnect , connection state is checked periodically
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case n := <-notifications:
+			reading, err := d.decode(addr, map[string][]byte{n.uuid: n.data})
+			if err != nil {
+				log.Infof("<Ad> Can't decode notification from %s : %s", addr, err)
+				continue
+			}
+			readings <- reading
+		case <-ticker.C:
+			if !dev.IsConnected() {
+				return errors.New("device disconnected")
+			}
+		case <-stop:
+			return nil
+		}
+	}
+}
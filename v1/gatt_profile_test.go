@@ -0,0 +1,66 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestProfileValueDecode(t *testing.T) {
+	payload := []byte{0x34, 0x08, 0xfe, 0xff, 0x80, 0x00, 0x00, 0xc0, 0x3f}
+	cases := []struct {
+		name     string
+		value    ProfileValue
+		expected float64
+		valid    bool
+	}{
+		{"uint8", ProfileValue{Type: "uint8", Offset: 4}, 128, true},
+		{"int8", ProfileValue{Type: "int8", Offset: 4}, -128, true},
+		{"uint16 little endian", ProfileValue{Type: "uint16"}, 2100, true},
+		{"uint16 big endian", ProfileValue{Type: "uint16", Endianness: "big"}, 13320, true},
+		{"int16 negative", ProfileValue{Type: "int16", Offset: 2}, -2, true},
+		{"uint16 of negative bytes", ProfileValue{Type: "uint16", Offset: 2}, 65534, true},
+		{"int32", ProfileValue{Type: "int32", Offset: 0}, -128972, true},
+		{"uint32", ProfileValue{Type: "uint32", Offset: 0}, 4294838324, true},
+		{"float32", ProfileValue{Type: "float32", Offset: 5}, 1.5, true},
+		{"scale", ProfileValue{Type: "int16", Scale: 0.01}, 21, true},
+		{"negative scale", ProfileValue{Type: "int16", Offset: 2, Scale: 0.5}, -1, true},
+		{"scale and add", ProfileValue{Type: "uint8", Offset: 4, Scale: 0.5, Add: -40}, 24, true},
+		{"add without scale", ProfileValue{Type: "uint8", Offset: 4, Add: 2}, 130, true},
+		{"last byte", ProfileValue{Type: "uint8", Offset: 8}, 0x3f, true},
+		{"past the end", ProfileValue{Type: "uint16", Offset: 8}, 0, false},
+		{"negative offset", ProfileValue{Type: "uint8", Offset: -1}, 0, false},
+		{"unknown type", ProfileValue{Type: "int64"}, 0, false},
+	}
+	for _, c := range cases {
+		v, err := c.value.Decode(payload)
+		if (err == nil) != c.valid {
+			t.Errorf("%s : expected valid %v , got %v", c.name, c.valid, err)
+			continue
+		}
+		if math.Abs(v-c.expected) > 1e-9 {
+			t.Errorf("%s : expected %v , got %v", c.name, c.expected, v)
+		}
+	}
+}
+
+func TestBundledProfileDecode(t *testing.T) {
+	profile, err := LoadGattProfile("profiles/lywsd03mmc.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &ProfileDriver{profile: profile}
+	// 21.5 C , 45 % and battery voltage
+	payloads := map[string][]byte{fullUUID("ebe0ccc1-7a0a-4b0c-8a1a-6ff2997da3a6"): {0x66, 0x08, 0x2d, 0x8e, 0x0b}}
+	reading, err := d.decode(testDeviceAddr, payloads)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for service, expected := range map[string]float64{"sensor_temp": 21.5, "sensor_humid": 45} {
+		if v, ok := readingValue(reading, service); !ok || math.Abs(v-expected) > 1e-9 {
+			t.Errorf("expected %s %v , got %v", service, expected, v)
+		}
+	}
+	if _, err := d.decode(testDeviceAddr, map[string][]byte{fullUUID("ebe0ccc1-7a0a-4b0c-8a1a-6ff2997da3a6"): {0x66, 0x08}}); err == nil {
+		t.Error("short payload was decoded")
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/alivinco/fimpgo"
+	"github.com/boltdb/bolt"
+)
+
+const defaultRawRetentionDays = 7
+const defaultHourlyRetentionDays = 365
+const historyCleanupInterval = time.Hour
+
+const (
+	AggregationRaw    = "raw"
+	AggregationHourly = "hourly"
+	AggregationDaily  = "daily"
+)
+
+var rawBucket = []byte("raw")
+var hourlyBucket = []byte("hourly")
+
+type HistoryConfig struct {
+	Enabled             bool
+	File                string // default history.db next to config
+	RawRetentionDays    int
+	HourlyRetentionDays int
+}
+
+// HistoryPoint is one value of a series. For aggregated series V is average of the period.
+type HistoryPoint struct {
+	T   int64   `json:"t"` // unix time in seconds , start of the period for aggregated series
+	V   float64 `json:"v"`
+	Min float64 `json:"min"`
+	Max float64 `json:"max"`
+}
+
+// HistoryStore keeps all readings in BoltDB. Every series (device + service) has raw values
+// and hourly aggregates , which are updated on insert and kept for longer time.
+type HistoryStore struct {
+	db     *bolt.DB
+	config HistoryConfig
+}
+
+func NewHistoryStore(config HistoryConfig) (*HistoryStore, error) {
+	if config.RawRetentionDays == 0 {
+		config.RawRetentionDays = defaultRawRetentionDays
+	}
+	if config.HourlyRetentionDays == 0 {
+		config.HourlyRetentionDays = defaultHourlyRetentionDays
+	}
+	db, err := bolt.Open(config.File, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(rawBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(hourlyBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	hs := &HistoryStore{db: db, config: config}
+	go hs.cleanupLoop()
+	return hs, nil
+}
+
+func (hs *HistoryStore) Name() string {
+	return "history"
+}
+
+func seriesKey(addr string, service string) []byte {
+	return []byte(addr + "|" + service)
+}
+
+func timeKey(t int64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(t))
+	return key
+}
+
+// hourly aggregate is stored as sum , min , max and count
+func encodeAggregate(sum, min, max float64, count uint64) []byte {
+	buf := make([]byte, 32)
+	binary.BigEndian.PutUint64(buf[0:], math.Float64bits(sum))
+	binary.BigEndian.PutUint64(buf[8:], math.Float64bits(min))
+	binary.BigEndian.PutUint64(buf[16:], math.Float64bits(max))
+	binary.BigEndian.PutUint64(buf[24:], count)
+	return buf
+}
+
+func decodeAggregate(buf []byte) (sum, min, max float64, count uint64) {
+	sum = math.Float64frombits(binary.BigEndian.Uint64(buf[0:]))
+	min = math.Float64frombits(binary.BigEndian.Uint64(buf[8:]))
+	max = math.Float64frombits(binary.BigEndian.Uint64(buf[16:]))
+	count = binary.BigEndian.Uint64(buf[24:])
+	return
+}
+
+func (hs *HistoryStore) PublishReading(reading *DeviceReading) {
+	err := hs.db.Update(func(tx *bolt.Tx) error {
+		for _, v := range reading.Values {
+			if err := hs.put(tx, reading.Address, v.Service, reading.Time, v.Value); err != nil {
+				return err
+			}
+		}
+		if reading.HasBattery {
+			return hs.put(tx, reading.Address, "battery", reading.Time, float64(reading.Battery))
+		}
+		return nil
+	})
+	if err != nil {
+		log.Error("<History> Can't store reading : ", err)
+	}
+}
+
+func (hs *HistoryStore) put(tx *bolt.Tx, addr string, service string, t time.Time, value float64) error {
+	key := seriesKey(addr, service)
+	raw, err := tx.Bucket(rawBucket).CreateBucketIfNotExists(key)
+	if err != nil {
+		return err
+	}
+	valueBuf := make([]byte, 8)
+	binary.BigEndian.PutUint64(valueBuf, math.Float64bits(value))
+	// sequence number keeps values read within the same second , readers use only the time prefix of the key
+	seq, err := raw.NextSequence()
+	if err != nil {
+		return err
+	}
+	if err = raw.Put(append(timeKey(t.Unix()), timeKey(int64(seq))...), valueBuf); err != nil {
+		return err
+	}
+	hourly, err := tx.Bucket(hourlyBucket).CreateBucketIfNotExists(key)
+	if err != nil {
+		return err
+	}
+	hourKey := timeKey(t.Truncate(time.Hour).Unix())
+	sum, min, max, count := value, value, value, uint64(1)
+	if existing := hourly.Get(hourKey); existing != nil {
+		eSum, eMin, eMax, eCount := decodeAggregate(existing)
+		sum += eSum
+		min = math.Min(min, eMin)
+		max = math.Max(max, eMax)
+		count += eCount
+	}
+	return hourly.Put(hourKey, encodeAggregate(sum, min, max, count))
+}
+
+// Query returns series of the device service between from and to.
+func (hs *HistoryStore) Query(addr string, service string, from time.Time, to time.Time, aggregation string) ([]HistoryPoint, error) {
+	points := []HistoryPoint{}
+	key := seriesKey(addr, service)
+	err := hs.db.View(func(tx *bolt.Tx) error {
+		switch aggregation {
+		case AggregationRaw, "":
+			series := tx.Bucket(rawBucket).Bucket(key)
+			if series == nil {
+				return nil
+			}
+			c := series.Cursor()
+			for k, v := c.Seek(timeKey(from.Unix())); k != nil && int64(binary.BigEndian.Uint64(k)) <= to.Unix(); k, v = c.Next() {
+				value := math.Float64frombits(binary.BigEndian.Uint64(v))
+				points = append(points, HistoryPoint{T: int64(binary.BigEndian.Uint64(k)), V: value, Min: value, Max: value})
+			}
+		case AggregationHourly, AggregationDaily:
+			series := tx.Bucket(hourlyBucket).Bucket(key)
+			if series == nil {
+				return nil
+			}
+			period := int64(3600)
+			if aggregation == AggregationDaily {
+				period = 86400
+			}
+			var sum float64
+			var count uint64
+			var current *HistoryPoint
+			c := series.Cursor()
+			for k, v := c.Seek(timeKey(from.Truncate(time.Hour).Unix())); k != nil && int64(binary.BigEndian.Uint64(k)) <= to.Unix(); k, v = c.Next() {
+				t := int64(binary.BigEndian.Uint64(k))
+				periodStart := t - t%period
+				hSum, hMin, hMax, hCount := decodeAggregate(v)
+				if current == nil || current.T != periodStart {
+					if current != nil {
+						current.V = sum / float64(count)
+						points = append(points, *current)
+					}
+					current = &HistoryPoint{T: periodStart, Min: hMin, Max: hMax}
+					sum, count = 0, 0
+				}
+				sum += hSum
+				count += hCount
+				current.Min = math.Min(current.Min, hMin)
+				current.Max = math.Max(current.Max, hMax)
+			}
+			if current != nil {
+				current.V = sum / float64(count)
+				points = append(points, *current)
+			}
+		default:
+			return errors.New("unsupported aggregation " + aggregation)
+		}
+		return nil
+	})
+	return points, err
+}
+
+func (hs *HistoryStore) cleanupLoop() {
+	for {
+		hs.cleanup()
+		time.Sleep(historyCleanupInterval)
+	}
+}
+
+// cleanup removes raw values and hourly aggregates which are older than retention period.
+func (hs *HistoryStore) cleanup() {
+	rawLimit := timeKey(time.Now().AddDate(0, 0, -hs.config.RawRetentionDays).Unix())
+	hourlyLimit := timeKey(time.Now().AddDate(0, 0, -hs.config.HourlyRetentionDays).Unix())
+	err := hs.db.Update(func(tx *bolt.Tx) error {
+		if err := deleteOlderThan(tx.Bucket(rawBucket), rawLimit); err != nil {
+			return err
+		}
+		return deleteOlderThan(tx.Bucket(hourlyBucket), hourlyLimit)
+	})
+	if err != nil {
+		log.Error("<History> Cleanup failed : ", err)
+	}
+}
+
+func deleteOlderThan(root *bolt.Bucket, limit []byte) error {
+	return root.ForEach(func(name, _ []byte) error {
+		series := root.Bucket(name)
+		if series == nil {
+			return nil
+		}
+		c := series.Cursor()
+		for k, _ := c.First(); k != nil && string(k) < string(limit); k, _ = c.First() {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// parseHistoryTime accepts unix time in seconds or RFC3339.
+func parseHistoryTime(value string, def time.Time) (time.Time, error) {
+	if value == "" {
+		return def, nil
+	}
+	if unix, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(unix, 0), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+type historyReport struct {
+	Device      string         `json:"device"`
+	Service     string         `json:"service"`
+	Aggregation string         `json:"aggregation"`
+	From        int64          `json:"from"`
+	To          int64          `json:"to"`
+	Points      []HistoryPoint `json:"points"`
+}
+
+// SendHistoryReport serves cmd.sensor.get_history . Request value is str_map with device , service , from , to and aggregation.
+func (mg *MiFloraAd) SendHistoryReport(request *fimpgo.FimpMessage) {
+	if mg.history == nil {
+		mg.sendAdapterErrorReport(request, ErrorUnavailable, "history is not enabled")
+		return
+	}
+	params, err := request.GetStrMapValue()
+	if err != nil {
+		mg.sendAdapterErrorReport(request, ErrorInvalidValue, "history request must be str_map")
+		return
+	}
+	to, err := parseHistoryTime(params["to"], time.Now())
+	if err != nil {
+		mg.sendAdapterErrorReport(request, ErrorInvalidValue, "invalid to : "+err.Error())
+		return
+	}
+	from, err := parseHistoryTime(params["from"], to.Add(-24*time.Hour))
+	if err != nil {
+		mg.sendAdapterErrorReport(request, ErrorInvalidValue, "invalid from : "+err.Error())
+		return
+	}
+	aggregation := params["aggregation"]
+	if aggregation == "" {
+		aggregation = AggregationRaw
+	}
+	if aggregation != AggregationRaw && aggregation != AggregationHourly && aggregation != AggregationDaily {
+		mg.sendAdapterErrorReport(request, ErrorInvalidValue, "unknown aggregation "+aggregation)
+		return
+	}
+	points, err := mg.history.Query(normalizeMac(params["device"]), params["service"], from, to, aggregation)
+	if err != nil {
+		mg.sendAdapterErrorReport(request, ErrorUnavailable, "history query failed : "+err.Error())
+		return
+	}
+	report := historyReport{Device: params["device"], Service: params["service"], Aggregation: aggregation,
+		From: from.Unix(), To: to.Unix(), Points: points}
+	msg := fimpgo.NewMessage("evt.sensor.history_report", "ble", fimpgo.VTypeObject, report, nil, nil, request)
+	fimpAddr, _ := fimpgo.NewAddressFromString("pt:j1/mt:evt/rt:ad/rn:ble/ad:1")
+	mg.msgTransport.Publish(fimpAddr, msg)
+}
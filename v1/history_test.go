@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestHistoryStore(t *testing.T) (*HistoryStore, func()) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs, err := NewHistoryStore(HistoryConfig{File: filepath.Join(dir, "history.db")})
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return hs, func() {
+		hs.db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func storeHistoryValue(hs *HistoryStore, t time.Time, value float64) {
+	reading := NewDeviceReading(testDeviceAddr, "miflora")
+	reading.Time = t
+	reading.Add("sensor_temp", value, "C")
+	hs.PublishReading(reading)
+}
+
+func TestHistoryKeepsValuesOfSameSecond(t *testing.T) {
+	hs, cleanup := newTestHistoryStore(t)
+	defer cleanup()
+	at := time.Now().Truncate(time.Second).Add(-time.Hour)
+	storeHistoryValue(hs, at, 20)
+	storeHistoryValue(hs, at.Add(300*time.Millisecond), 21)
+	storeHistoryValue(hs, at.Add(time.Second), 22)
+
+	points, err := hs.Query(testDeviceAddr, "sensor_temp", at, at.Add(time.Minute), AggregationRaw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(points) != 3 {
+		t.Fatalf("expected 3 raw points , got %+v", points)
+	}
+	for i, expected := range []float64{20, 21, 22} {
+		if points[i].V != expected {
+			t.Errorf("point %d : expected %v , got %v", i, expected, points[i].V)
+		}
+	}
+	if points[0].T != at.Unix() || points[1].T != at.Unix() || points[2].T != at.Unix()+1 {
+		t.Errorf("unexpected point times %+v", points)
+	}
+}
+
+func TestHistoryRollup(t *testing.T) {
+	hs, cleanup := newTestHistoryStore(t)
+	defer cleanup()
+	// yesterday 10:00 UTC , daily periods are UTC days
+	day := time.Now().UTC().Truncate(24 * time.Hour).Add(-24 * time.Hour)
+	hour := day.Add(10 * time.Hour)
+	storeHistoryValue(hs, hour, 10)
+	storeHistoryValue(hs, hour, 20)
+	storeHistoryValue(hs, hour.Add(59*time.Minute), 30)
+	storeHistoryValue(hs, hour.Add(time.Hour), 60)
+
+	cases := []struct {
+		aggregation string
+		expected    []HistoryPoint
+	}{
+		{AggregationHourly, []HistoryPoint{{T: hour.Unix(), V: 20, Min: 10, Max: 30}, {T: hour.Add(time.Hour).Unix(), V: 60, Min: 60, Max: 60}}},
+		// daily average is weighted by number of values , not average of hourly averages
+		{AggregationDaily, []HistoryPoint{{T: day.Unix(), V: 30, Min: 10, Max: 60}}},
+	}
+	for _, c := range cases {
+		points, err := hs.Query(testDeviceAddr, "sensor_temp", day, day.Add(24*time.Hour), c.aggregation)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(points) != len(c.expected) {
+			t.Errorf("%s : expected %+v , got %+v", c.aggregation, c.expected, points)
+			continue
+		}
+		for i := range points {
+			if points[i] != c.expected[i] {
+				t.Errorf("%s : expected %+v , got %+v", c.aggregation, c.expected[i], points[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+type HomeAssistantConfig struct {
+	Enabled          bool
+	DiscoveryPrefix  string // default homeassistant
+	StateTopicPrefix string // state is published to <prefix>/<mac>/state , default ble-ad
+}
+
+type haServiceInfo struct {
+	DeviceClass string
+	Unit        string
+	StateClass  string
+	Name        string
+}
+
+// haServices maps FIMP services to Home Assistant sensor attributes.
+var haServices = map[string]haServiceInfo{
+	"sensor_temp":       {DeviceClass: "temperature", Unit: "°C", StateClass: "measurement", Name: "temperature"},
+	"sensor_lumin":      {DeviceClass: "illuminance", Unit: "lx", StateClass: "measurement", Name: "light"},
+	"sensor_humid":      {DeviceClass: "humidity", Unit: "%", StateClass: "measurement", Name: "humidity"},
+	"sensor_moist":      {DeviceClass: "moisture", Unit: "%", StateClass: "measurement", Name: "soil moisture"},
+	"sensor_conduct":    {Unit: "µS/cm", StateClass: "measurement", Name: "conductivity"},
+	"sensor_dli":        {Unit: "mol/m²/d", StateClass: "measurement", Name: "daily light integral"},
+	"sensor_dew":        {Unit: "°C", StateClass: "measurement", Name: "dew point"},
+	"sensor_abs_humid":  {Unit: "g/m³", StateClass: "measurement", Name: "absolute humidity"},
+	"sensor_vpd":        {DeviceClass: "pressure", Unit: "kPa", StateClass: "measurement", Name: "vapour pressure deficit"},
+	"sensor_heat_index": {DeviceClass: "temperature", Unit: "°C", StateClass: "measurement", Name: "heat index"},
+	"battery":           {DeviceClass: "battery", Unit: "%", StateClass: "measurement", Name: "battery"},
+}
+
+type haDevice struct {
+	Identifiers  []string   `json:"identifiers"`
+	Connections  [][]string `json:"connections"`
+	Name         string     `json:"name"`
+	Manufacturer string     `json:"manufacturer,omitempty"`
+	Model        string     `json:"model,omitempty"`
+	SwVersion    string     `json:"sw_version,omitempty"`
+}
+
+type haSensorConfig struct {
+	Name              string   `json:"name"`
+	UniqueId          string   `json:"unique_id"`
+	StateTopic        string   `json:"state_topic"`
+	ValueTemplate     string   `json:"value_template"`
+	DeviceClass       string   `json:"device_class,omitempty"`
+	UnitOfMeasurement string   `json:"unit_of_measurement,omitempty"`
+	StateClass        string   `json:"state_class,omitempty"`
+	Device            haDevice `json:"device"`
+}
+
+// HomeAssistantSink publishes MQTT discovery configs and per device state JSON for Home Assistant.
+type HomeAssistantSink struct {
+	config    HomeAssistantConfig
+	transport FimpTransport
+	announced map[string]bool                   // device/service pairs for which discovery config was published
+	states    map[string]map[string]interface{} // addr -> last known value of every service
+	lock      sync.Mutex
+	meta      func(addr string) DeviceMeta
+}
+
+func NewHomeAssistantSink(config HomeAssistantConfig, transport FimpTransport, meta func(addr string) DeviceMeta) *HomeAssistantSink {
+	if config.DiscoveryPrefix == "" {
+		config.DiscoveryPrefix = "homeassistant"
+	}
+	if config.StateTopicPrefix == "" {
+		config.StateTopicPrefix = "ble-ad"
+	}
+	return &HomeAssistantSink{config: config, transport: transport, announced: map[string]bool{}, states: map[string]map[string]interface{}{}, meta: meta}
+}
+
+func (ha *HomeAssistantSink) Name() string {
+	return "homeassistant"
+}
+
+func haObjectId(addr string) string {
+	return "ble_" + strings.ToLower(strings.Replace(addr, ":", "", -1))
+}
+
+func (ha *HomeAssistantSink) stateTopic(addr string) string {
+	return ha.config.StateTopicPrefix + "/" + macToFimpMac(addr) + "/state"
+}
+
+// PublishReading publishes retained state with last known value of every service , so value templates of services
+// missing in the reading , for instance dropped by plausibility filter , keep working.
+func (ha *HomeAssistantSink) PublishReading(reading *DeviceReading) {
+	for _, v := range reading.Values {
+		ha.announce(reading, v.Service)
+	}
+	if reading.HasBattery {
+		ha.announce(reading, "battery")
+	}
+	ha.lock.Lock()
+	state := ha.states[reading.Address]
+	if state == nil {
+		state = map[string]interface{}{}
+		ha.states[reading.Address] = state
+	}
+	for _, v := range reading.Values {
+		state[v.Service] = v.Value
+	}
+	if reading.HasBattery {
+		state["battery"] = reading.Battery
+	}
+	body, _ := json.Marshal(state)
+	ha.lock.Unlock()
+	if err := ha.transport.PublishRaw(ha.stateTopic(reading.Address), body, 1, true); err != nil {
+		log.Error("<HA> Can't publish state : ", err)
+	}
+}
+
+// announce publishes retained discovery config when service of the device is seen for the first time.
+func (ha *HomeAssistantSink) announce(reading *DeviceReading, service string) {
+	info, ok := haServices[service]
+	if !ok {
+		info = haServiceInfo{Name: service, StateClass: "measurement"}
+	}
+	objectId := haObjectId(reading.Address)
+	key := objectId + "/" + service
+	ha.lock.Lock()
+	defer ha.lock.Unlock()
+	if ha.announced[key] {
+		return
+	}
+	meta := ha.meta(reading.Address)
+	deviceName := reading.Alias
+	if deviceName == "" {
+		deviceName = meta.Name + " " + reading.Address
+	}
+	config := haSensorConfig{
+		Name:              deviceName + " " + info.Name,
+		UniqueId:          objectId + "_" + service,
+		StateTopic:        ha.stateTopic(reading.Address),
+		ValueTemplate:     "{{ value_json." + service + " }}",
+		DeviceClass:       info.DeviceClass,
+		UnitOfMeasurement: info.Unit,
+		StateClass:        info.StateClass,
+		Device: haDevice{
+			Identifiers:  []string{objectId},
+			Connections:  [][]string{{"mac", reading.Address}},
+			Name:         deviceName,
+			Manufacturer: meta.Manufacturer,
+			Model:        meta.Model,
+			SwVersion:    meta.Firmware,
+		},
+	}
+	body, _ := json.Marshal(config)
+	topic := ha.config.DiscoveryPrefix + "/sensor/" + objectId + "/" + service + "/config"
+	if err := ha.transport.PublishRaw(topic, body, 1, true); err != nil {
+		log.Error("<HA> Can't publish discovery config : ", err)
+		return
+	}
+	ha.announced[key] = true
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestHomeAssistantStateKeepsLastValues(t *testing.T) {
+	transport := &captureTransport{}
+	ha := NewHomeAssistantSink(HomeAssistantConfig{Enabled: true}, transport, func(addr string) DeviceMeta {
+		return DeviceMeta{Name: "Flower care"}
+	})
+	first := NewDeviceReading(testDeviceAddr, "miflora")
+	first.Add("sensor_temp", 21.5, "C")
+	first.Add("sensor_moist", 30, "%")
+	first.SetBattery(90)
+	ha.PublishReading(first)
+	// temperature was dropped , for instance by plausibility filter
+	second := NewDeviceReading(testDeviceAddr, "miflora")
+	second.Add("sensor_moist", 28, "%")
+	ha.PublishReading(second)
+
+	var state map[string]interface{}
+	if err := json.Unmarshal(transport.retained[ha.stateTopic(testDeviceAddr)], &state); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{"sensor_temp": 21.5, "sensor_moist": 28.0, "battery": 90.0}
+	if !reflect.DeepEqual(state, expected) {
+		t.Errorf("expected state %v , got %v", expected, state)
+	}
+	if _, ok := transport.retained["homeassistant/sensor/"+haObjectId(testDeviceAddr)+"/sensor_temp/config"]; !ok {
+		t.Error("discovery config of sensor_temp wasn't published")
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	HomieStateInit  = "init"
+	HomieStateReady = "ready"
+	HomieStateLost  = "lost"
+)
+
+type HomieConfig struct {
+	Enabled   bool
+	BaseTopic string // default homie
+}
+
+type homieProperty struct {
+	NodeName string
+	Property string
+	Name     string
+	DataType string
+	Unit     string
+}
+
+// homieProperties maps FIMP services to Homie nodes. Node id is service name with hyphen instead of underscore.
+var homieProperties = map[string]homieProperty{
+	"sensor_temp":       {NodeName: "Temperature", Property: "value", Name: "Temperature", DataType: "float", Unit: "°C"},
+	"sensor_lumin":      {NodeName: "Light", Property: "value", Name: "Illuminance", DataType: "float", Unit: "lx"},
+	"sensor_humid":      {NodeName: "Humidity", Property: "value", Name: "Humidity", DataType: "float", Unit: "%"},
+	"sensor_moist":      {NodeName: "Soil moisture", Property: "value", Name: "Soil moisture", DataType: "float", Unit: "%"},
+	"sensor_conduct":    {NodeName: "Conductivity", Property: "value", Name: "Conductivity", DataType: "float", Unit: "µS/cm"},
+	"sensor_dew":        {NodeName: "Dew point", Property: "value", Name: "Dew point", DataType: "float", Unit: "°C"},
+	"sensor_abs_humid":  {NodeName: "Absolute humidity", Property: "value", Name: "Absolute humidity", DataType: "float", Unit: "g/m³"},
+	"sensor_vpd":        {NodeName: "Vapour pressure deficit", Property: "value", Name: "Vapour pressure deficit", DataType: "float", Unit: "kPa"},
+	"sensor_heat_index": {NodeName: "Heat index", Property: "value", Name: "Heat index", DataType: "float", Unit: "°C"},
+	"sensor_dli":        {NodeName: "Daily light integral", Property: "value", Name: "Daily light integral", DataType: "float", Unit: "mol/m²/d"},
+	"battery":           {NodeName: "Battery", Property: "level", Name: "Battery level", DataType: "integer", Unit: "%"},
+}
+
+type homieDevice struct {
+	state string
+	nodes map[string]bool // FIMP service names
+}
+
+// HomieSink publishes devices according to Homie 4 convention.
+type HomieSink struct {
+	config    HomieConfig
+	transport FimpTransport
+	devices   map[string]*homieDevice
+	lock      sync.Mutex
+	meta      func(addr string) DeviceMeta
+}
+
+// homieFirmwareExtension adds $fw attributes , model and firmware version are published in them
+const homieFirmwareExtension = "org.homie.legacy-firmware:0.1.1:[4.x]"
+
+func NewHomieSink(config HomieConfig, transport FimpTransport, meta func(addr string) DeviceMeta) *HomieSink {
+	if config.BaseTopic == "" {
+		config.BaseTopic = "homie"
+	}
+	return &HomieSink{config: config, transport: transport, devices: map[string]*homieDevice{}, meta: meta}
+}
+
+func (hs *HomieSink) Name() string {
+	return "homie"
+}
+
+func homieDeviceId(addr string) string {
+	return "ble-" + strings.ToLower(strings.Replace(addr, ":", "", -1))
+}
+
+func homieNodeId(service string) string {
+	return strings.Replace(service, "_", "-", -1)
+}
+
+func homiePropertyFor(service string) homieProperty {
+	if prop, ok := homieProperties[service]; ok {
+		return prop
+	}
+	return homieProperty{NodeName: service, Property: "value", Name: service, DataType: "float"}
+}
+
+func (hs *HomieSink) publish(topic string, value string) {
+	if err := hs.transport.PublishRaw(hs.config.BaseTopic+"/"+topic, []byte(value), 1, true); err != nil {
+		log.Errorf("<Homie> Can't publish %s : %s", topic, err)
+	}
+}
+
+func (hs *HomieSink) PublishReading(reading *DeviceReading) {
+	values := map[string]string{}
+	for _, v := range reading.Values {
+		values[v.Service] = strconv.FormatFloat(v.Value, 'f', -1, 64)
+	}
+	if reading.HasBattery {
+		values["battery"] = strconv.Itoa(reading.Battery)
+	}
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	devId := homieDeviceId(reading.Address)
+	dev := hs.devices[devId]
+	if dev == nil {
+		dev = &homieDevice{nodes: map[string]bool{}}
+		hs.devices[devId] = dev
+	}
+	structureChanged := false
+	for service := range values {
+		if !dev.nodes[service] {
+			dev.nodes[service] = true
+			structureChanged = true
+		}
+	}
+	if structureChanged {
+		hs.announce(devId, reading, dev)
+	}
+	for service, value := range values {
+		hs.publish(devId+"/"+homieNodeId(service)+"/"+homiePropertyFor(service).Property, value)
+	}
+	hs.setState(devId, dev, HomieStateReady)
+}
+
+// announce (re)publishes device and node attributes. Device is switched to init while structure is changing.
+func (hs *HomieSink) announce(devId string, reading *DeviceReading, dev *homieDevice) {
+	hs.setState(devId, dev, HomieStateInit)
+	meta := hs.meta(reading.Address)
+	name := reading.Alias
+	if name == "" {
+		name = meta.Name + " " + reading.Address
+	}
+	hs.publish(devId+"/$homie", "4.0")
+	hs.publish(devId+"/$name", name)
+	hs.publish(devId+"/$extensions", homieFirmwareExtension)
+	hs.publish(devId+"/$fw/name", meta.Model)
+	hs.publish(devId+"/$fw/version", meta.Firmware)
+	var nodeIds []string
+	for service := range dev.nodes {
+		prop := homiePropertyFor(service)
+		nodeId := homieNodeId(service)
+		nodeIds = append(nodeIds, nodeId)
+		hs.publish(devId+"/"+nodeId+"/$name", prop.NodeName)
+		hs.publish(devId+"/"+nodeId+"/$type", service)
+		hs.publish(devId+"/"+nodeId+"/$properties", prop.Property)
+		hs.publish(devId+"/"+nodeId+"/"+prop.Property+"/$name", prop.Name)
+		hs.publish(devId+"/"+nodeId+"/"+prop.Property+"/$datatype", prop.DataType)
+		if prop.Unit != "" {
+			hs.publish(devId+"/"+nodeId+"/"+prop.Property+"/$unit", prop.Unit)
+		}
+	}
+	sort.Strings(nodeIds)
+	hs.publish(devId+"/$nodes", strings.Join(nodeIds, ","))
+}
+
+func (hs *HomieSink) setState(devId string, dev *homieDevice, state string) {
+	if dev.state == state {
+		return
+	}
+	dev.state = state
+	hs.publish(devId+"/$state", state)
+}
+
+// DeviceUnreachable marks device as lost , it goes back to ready with next successful reading.
+func (hs *HomieSink) DeviceUnreachable(addr string) {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	devId := homieDeviceId(addr)
+	if dev := hs.devices[devId]; dev != nil {
+		hs.setState(devId, dev, HomieStateLost)
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"html/template"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/muka/go-bluetooth/api"
+)
+
+// maxScanDuration limits discovery started over API , reads on all adapters are disturbed while it runs.
+const maxScanDuration = 30 * time.Second
+
+// deviceView is configuration and state of the device returned by HTTP API.
+type deviceView struct {
+	Config DeviceConfig `json:"config"`
+	State  DeviceState  `json:"state"`
+}
+
+type scannedDevice struct {
+	Address string `json:"address"`
+	Name    string `json:"name"`
+	Rssi    int16  `json:"rssi"`
+	Adapter string `json:"adapter"`
+	Managed bool   `json:"managed"`
+}
+
+func (mg *MiFloraAd) startHttpServer() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", mg.httpStatusPage)
+	mux.HandleFunc("/devices", mg.httpDevices)
+	mux.HandleFunc("/devices/", mg.httpDevice)
+	mux.HandleFunc("/scan", mg.httpScan)
+	go func() {
+		log.Info("<Http> Listening on ", mg.config.HttpListenAddress)
+		if err := http.ListenAndServe(mg.config.HttpListenAddress, mux); err != nil {
+			log.Error("<Http> Server stopped : ", err)
+		}
+	}()
+}
+
+func writeJson(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeJsonError(w http.ResponseWriter, status int, msg string) {
+	writeJson(w, status, map[string]string{"error": msg})
+}
+
+// authorized checks API token of requests which change something. Without configured token only local requests are accepted.
+func (mg *MiFloraAd) authorized(w http.ResponseWriter, r *http.Request) bool {
+	ok := false
+	if mg.config.HttpApiToken == "" {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		ip := net.ParseIP(host)
+		ok = err == nil && ip != nil && ip.IsLoopback()
+	} else {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		ok = subtle.ConstantTimeCompare([]byte(token), []byte(mg.config.HttpApiToken)) == 1
+	}
+	if !ok {
+		writeJsonError(w, http.StatusUnauthorized, "unauthorized")
+	}
+	return ok
+}
+
+func (mg *MiFloraAd) deviceViews() []deviceView {
+	var devices []deviceView
+	for _, addr := range mg.deviceList() {
+		devices = append(devices, deviceView{Config: mg.getDeviceConfig(addr), State: mg.getDeviceState(addr)})
+	}
+	return devices
+}
+
+// httpDevices serves GET /devices and POST /devices
+func (mg *MiFloraAd) httpDevices(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		writeJson(w, http.StatusOK, mg.deviceViews())
+	case "POST":
+		if !mg.authorized(w, r) {
+			return
+		}
+		var conf DeviceConfig
+		if err := json.NewDecoder(r.Body).Decode(&conf); err != nil || conf.Address == "" {
+			writeJsonError(w, http.StatusBadRequest, "device config with address is expected")
+			return
+		}
+		conf.Address = normalizeMac(conf.Address)
+		if problems := validateDevice(conf, mg.adapterNames); len(problems) > 0 {
+			writeJsonError(w, http.StatusBadRequest, strings.Join(problems, " ; "))
+			return
+		}
+		if err := mg.addDevice(conf); err != nil {
+			writeJsonError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		mg.enqueueSensorRequest(conf.Address)
+		writeJson(w, http.StatusCreated, deviceView{Config: conf, State: mg.getDeviceState(conf.Address)})
+	default:
+		writeJsonError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// httpDevice serves GET and DELETE /devices/{mac} and POST /devices/{mac}/read
+func (mg *MiFloraAd) httpDevice(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/devices/"), "/"), "/")
+	addr := normalizeMac(parts[0])
+	if !mg.isManagedDevice(addr) {
+		writeJsonError(w, http.StatusNotFound, "unknown device")
+		return
+	}
+	switch {
+	case len(parts) == 1 && r.Method == "GET":
+		writeJson(w, http.StatusOK, deviceView{Config: mg.getDeviceConfig(addr), State: mg.getDeviceState(addr)})
+	case len(parts) == 1 && r.Method == "DELETE":
+		if !mg.authorized(w, r) {
+			return
+		}
+		if _, err := mg.removeDevice(addr); err != nil {
+			writeJsonError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 2 && parts[1] == "read" && r.Method == "POST":
+		if !mg.authorized(w, r) {
+			return
+		}
+		mg.enqueueSensorRequest(addr)
+		writeJson(w, http.StatusAccepted, map[string]string{"status": "queued", "adapter": mg.adapterForDevice(addr).Name})
+	default:
+		writeJsonError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// httpScan serves GET /scan . Optional duration parameter (seconds , up to 30) runs discovery before devices are listed.
+func (mg *MiFloraAd) httpScan(w http.ResponseWriter, r *http.Request) {
+	if d, err := strconv.Atoi(r.URL.Query().Get("duration")); err == nil && d > 0 {
+		if !mg.authorized(w, r) {
+			return
+		}
+		duration := time.Duration(d) * time.Second
+		if duration > maxScanDuration {
+			duration = maxScanDuration
+		}
+		mg.lock.Lock()
+		scanning := mg.scanning
+		mg.scanning = true
+		mg.lock.Unlock()
+		if scanning {
+			writeJsonError(w, http.StatusConflict, "scan is already running")
+			return
+		}
+		mg.scanAdapters(duration)
+		mg.lock.Lock()
+		mg.scanning = false
+		mg.lock.Unlock()
+	}
+	devices, err := api.GetDevices()
+	if err != nil {
+		writeJsonError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	result := []scannedDevice{}
+	for i := range devices {
+		props, err := devices[i].GetProperties()
+		if err != nil {
+			continue
+		}
+		result = append(result, scannedDevice{Address: props.Address, Name: props.Name, Rssi: props.RSSI,
+			Adapter: path.Base(string(props.Adapter)), Managed: mg.isManagedDevice(props.Address)})
+	}
+	writeJson(w, http.StatusOK, result)
+}
+
+type statusPageAdapter struct {
+	Name        string
+	State       string
+	FailedReads int
+}
+
+var statusPageTemplate = template.Must(template.New("status").Funcs(template.FuncMap{
+	"ago": func(t time.Time) string {
+		if t.IsZero() {
+			return "never"
+		}
+		return time.Since(t).Truncate(time.Second).String() + " ago"
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>BLE adapter</title>
+<style>body{font-family:sans-serif} table{border-collapse:collapse} td,th{border:1px solid #ccc;padding:4px 8px} .err{color:#b00}</style>
+</head>
+<body>
+<h2>Adapters</h2>
+<table>
+<tr><th>Name</th><th>State</th><th>Failed reads</th></tr>
+{{range .Adapters}}<tr><td>{{.Name}}</td><td>{{.State}}</td><td>{{.FailedReads}}</td></tr>
+{{end}}</table>
+<h2>Devices</h2>
+<table>
+<tr><th>Address</th><th>Alias</th><th>Adapter</th><th>Values</th><th>Battery</th><th>Last success</th><th>Error</th></tr>
+{{range .Devices}}<tr><td>{{.Config.Address}}</td><td>{{.Config.Alias}}</td><td>{{.State.Adapter}}</td>
+<td>{{with .State.LastReading}}{{range .Values}}{{.Service}}: {{.Value}} {{.Unit}}<br>{{end}}{{end}}</td>
+<td>{{with .State.LastReading}}{{if .HasBattery}}{{.Battery}}%{{end}}{{end}}{{with .State.Battery}}{{if ge .DaysRemaining 0.0}}<br>~{{printf "%.0f" .DaysRemaining}} days left{{end}}{{end}}</td>
+<td>{{ago .State.LastSuccess}}</td><td class="err">{{.State.LastError}}</td></tr>
+{{end}}</table>
+<p>MQTT connected : {{.MqttConnected}} , queued events : {{.QueueSize}}</p>
+</body>
+</html>
+`))
+
+func (mg *MiFloraAd) httpStatusPage(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	var adapters []statusPageAdapter
+	mg.lock.Lock()
+	for _, name := range mg.adapterNames {
+		a := mg.adapters[name]
+		adapters = append(adapters, statusPageAdapter{Name: a.Name, State: a.State, FailedReads: a.FailedReads})
+	}
+	mg.lock.Unlock()
+	data := map[string]interface{}{
+		"Adapters":      adapters,
+		"Devices":       mg.deviceViews(),
+		"MqttConnected": mg.msgTransport.IsConnected(),
+		"QueueSize":     mg.offlineQueue.Len(),
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := statusPageTemplate.Execute(w, data); err != nil {
+		log.Error("<Http> Can't render status page : ", err)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHttpAddDevice(t *testing.T) {
+	cases := []struct {
+		name   string
+		token  string
+		body   string
+		status int
+	}{
+		{"valid", "secret", `{"Address":"c4-7c-8d-6a-3e-8b","Alias":"ficus","Calibration":{"sensor_temp":{"Offset":-0.5}}}`, http.StatusCreated},
+		{"without token", "", `{"Address":"C4:7C:8D:6A:3E:8B"}`, http.StatusUnauthorized},
+		{"wrong token", "guess", `{"Address":"C4:7C:8D:6A:3E:8B"}`, http.StatusUnauthorized},
+		{"not json", "secret", `C4:7C:8D:6A:3E:8B`, http.StatusBadRequest},
+		{"without address", "secret", `{"Alias":"ficus"}`, http.StatusBadRequest},
+		{"invalid address", "secret", `{"Address":"C4:7C:8D:6A:3E"}`, http.StatusBadRequest},
+		{"unknown driver", "secret", `{"Address":"C4:7C:8D:6A:3E:8B","Driver":"toaster"}`, http.StatusBadRequest},
+		{"unknown adapter", "secret", `{"Address":"C4:7C:8D:6A:3E:8B","Adapter":"hci7"}`, http.StatusBadRequest},
+		{"zero gain", "secret", `{"Address":"C4:7C:8D:6A:3E:8B","Calibration":{"sensor_temp":{"Gain":0}}}`, http.StatusBadRequest},
+		{"unsorted points", "secret", `{"Address":"C4:7C:8D:6A:3E:8B","Calibration":{"sensor_moist":{"Points":[[50,40],[10,5]]}}}`, http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			mg, _ := newTestAdapter(t, MifloraConfig{HttpApiToken: "secret"}, nil)
+			defer os.RemoveAll(filepath.Dir(mg.configPath))
+			mg.adapterNames = []string{"hci0"}
+			mg.adapters = map[string]*HciAdapter{"hci0": NewHciAdapter("hci0")}
+
+			r := httptest.NewRequest("POST", "/devices", strings.NewReader(c.body))
+			if c.token != "" {
+				r.Header.Set("Authorization", "Bearer "+c.token)
+			}
+			w := httptest.NewRecorder()
+			mg.httpDevices(w, r)
+			if w.Code != c.status {
+				t.Fatalf("expected status %d , got %d : %s", c.status, w.Code, w.Body.String())
+			}
+			if c.status != http.StatusCreated {
+				if mg.isManagedDevice(testDeviceAddr) {
+					t.Error("rejected device was added")
+				}
+				if _, err := os.Stat(mg.configPath); !os.IsNotExist(err) {
+					t.Error("config was saved")
+				}
+				return
+			}
+			var view deviceView
+			if err := json.NewDecoder(w.Body).Decode(&view); err != nil {
+				t.Fatal(err)
+			}
+			if view.Config.Address != testDeviceAddr || !mg.isManagedDevice(testDeviceAddr) {
+				t.Errorf("device wasn't added under normalized address , response %+v", view.Config)
+			}
+			saved, err := LoadConfig(mg.configPath)
+			if err != nil || len(saved.Devices) != 1 || saved.Devices[0].Alias != "ficus" {
+				t.Errorf("device wasn't saved to config : %+v %v", saved.Devices, err)
+			}
+		})
+	}
+}
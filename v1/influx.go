@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const defaultInfluxBatchSize = 100
+const defaultInfluxFlushInterval = 10 // seconds
+const defaultInfluxMaxRetries = 3
+const defaultInfluxFallbackMaxLines = 50000
+const defaultInfluxFallbackMaxAge = 604800 // seconds , 7 days
+
+type InfluxConfig struct {
+	Enabled          bool
+	URL              string // for instance http://localhost:8086
+	Version          int    // 1 or 2 , default 1
+	Database         string // v1
+	RetentionPolicy  string // v1 , optional
+	Username         string // v1
+	Password         string // v1
+	Org              string // v2
+	Bucket           string // v2
+	Token            string // v2
+	Measurement      string // default ble_sensor
+	BatchSize        int    // number of lines which triggers write
+	FlushInterval    int    // max time in seconds between writes
+	MaxRetries       int
+	FallbackFile     string // lines which couldn't be written are appended to the file and written later
+	FallbackMaxLines int    // the oldest lines are dropped when fallback file grows over the limit , default 50000
+	FallbackMaxAge   int    // seconds , older lines are dropped from fallback file , default 7 days
+}
+
+// InfluxSink batches readings as line protocol and writes them over Influx HTTP write API.
+type InfluxSink struct {
+	config     InfluxConfig
+	httpClient *http.Client
+	lines      []string
+	lock       sync.Mutex
+	writeLock  sync.Mutex    // serializes writes , so batches don't overtake each other
+	retryDelay time.Duration // delay before first retry , doubled with every attempt
+}
+
+func NewInfluxSink(config InfluxConfig) *InfluxSink {
+	if config.Version == 0 {
+		config.Version = 1
+	}
+	if config.Measurement == "" {
+		config.Measurement = "ble_sensor"
+	}
+	if config.BatchSize == 0 {
+		config.BatchSize = defaultInfluxBatchSize
+	}
+	if config.FlushInterval == 0 {
+		config.FlushInterval = defaultInfluxFlushInterval
+	}
+	if config.MaxRetries == 0 {
+		config.MaxRetries = defaultInfluxMaxRetries
+	}
+	if config.FallbackMaxLines == 0 {
+		config.FallbackMaxLines = defaultInfluxFallbackMaxLines
+	}
+	if config.FallbackMaxAge == 0 {
+		config.FallbackMaxAge = defaultInfluxFallbackMaxAge
+	}
+	is := &InfluxSink{config: config, httpClient: &http.Client{Timeout: 10 * time.Second}, retryDelay: time.Second}
+	go is.flushLoop()
+	return is
+}
+
+func (is *InfluxSink) Name() string {
+	return "influx"
+}
+
+var influxTagEscaper = strings.NewReplacer(",", "\\,", " ", "\\ ", "=", "\\=")
+var influxMeasurementEscaper = strings.NewReplacer(",", "\\,", " ", "\\ ")
+
+// lineProtocol converts reading into one line. Returns empty string if reading has no fields.
+func (is *InfluxSink) lineProtocol(reading *DeviceReading) string {
+	var fields []string
+	for _, v := range reading.Values {
+		fields = append(fields, influxTagEscaper.Replace(v.Service)+"="+strconv.FormatFloat(v.Value, 'f', -1, 64))
+	}
+	if reading.HasBattery {
+		fields = append(fields, "battery="+strconv.Itoa(reading.Battery)+"i")
+	}
+	if reading.HasRssi {
+		fields = append(fields, "rssi="+strconv.Itoa(reading.Rssi)+"i")
+	}
+	if len(fields) == 0 {
+		return ""
+	}
+	sort.Strings(fields)
+	tags := []string{"mac=" + influxTagEscaper.Replace(reading.Address)}
+	if reading.Alias != "" {
+		tags = append(tags, "alias="+influxTagEscaper.Replace(reading.Alias))
+	}
+	if reading.Type != "" {
+		tags = append(tags, "type="+influxTagEscaper.Replace(reading.Type))
+	}
+	return fmt.Sprintf("%s,%s %s %d", influxMeasurementEscaper.Replace(is.config.Measurement),
+		strings.Join(tags, ","), strings.Join(fields, ","), reading.Time.UnixNano())
+}
+
+func (is *InfluxSink) PublishReading(reading *DeviceReading) {
+	line := is.lineProtocol(reading)
+	if line == "" {
+		return
+	}
+	is.lock.Lock()
+	is.lines = append(is.lines, line)
+	full := len(is.lines) >= is.config.BatchSize
+	is.lock.Unlock()
+	if full {
+		go is.Flush()
+	}
+}
+
+func (is *InfluxSink) flushLoop() {
+	for {
+		time.Sleep(time.Duration(is.config.FlushInterval) * time.Second)
+		is.Flush()
+	}
+}
+
+// Flush writes buffered lines , lines from fallback file are written first.
+func (is *InfluxSink) Flush() {
+	is.lock.Lock()
+	lines := is.lines
+	is.lines = nil
+	is.lock.Unlock()
+
+	is.writeLock.Lock()
+	defer is.writeLock.Unlock()
+	pending := is.loadFallback()
+	if len(pending) > 0 {
+		retryable, err := is.writeWithRetry(pending)
+		if err != nil && retryable {
+			is.saveFallback(lines)
+			return
+		}
+		if err != nil {
+			log.Errorf("<Influx> %d lines from fallback file were rejected : %s", len(pending), err)
+		} else {
+			log.Infof("<Influx> %d lines from fallback file were written", len(pending))
+		}
+		os.Remove(is.config.FallbackFile)
+	}
+	if len(lines) == 0 {
+		return
+	}
+	retryable, err := is.writeWithRetry(lines)
+	if err != nil {
+		log.Error("<Influx> Write failed : ", err)
+		if retryable {
+			is.saveFallback(lines)
+		}
+	}
+}
+
+func (is *InfluxSink) writeWithRetry(lines []string) (retryable bool, err error) {
+	for i := 0; i < is.config.MaxRetries; i++ {
+		retryable, err = is.write(lines)
+		if err == nil || !retryable {
+			return
+		}
+		time.Sleep(is.retryDelay << uint(i))
+	}
+	return
+}
+
+// write sends lines in one request. Returns true if the error is temporary and request can be retried.
+func (is *InfluxSink) write(lines []string) (bool, error) {
+	body := strings.Join(lines, "\n")
+	req, err := http.NewRequest("POST", is.writeURL(), bytes.NewBufferString(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if is.config.Version == 2 {
+		req.Header.Set("Authorization", "Token "+is.config.Token)
+	} else if is.config.Username != "" {
+		req.SetBasicAuth(is.config.Username, is.config.Password)
+	}
+	resp, err := is.httpClient.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		return false, nil
+	}
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	err = fmt.Errorf("influx responded with %d : %s", resp.StatusCode, strings.TrimSpace(string(respBody)))
+	retryable := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	return retryable, err
+}
+
+func (is *InfluxSink) writeURL() string {
+	params := url.Values{}
+	params.Set("precision", "ns")
+	base := strings.TrimSuffix(is.config.URL, "/")
+	if is.config.Version == 2 {
+		params.Set("org", is.config.Org)
+		params.Set("bucket", is.config.Bucket)
+		return base + "/api/v2/write?" + params.Encode()
+	}
+	params.Set("db", is.config.Database)
+	if is.config.RetentionPolicy != "" {
+		params.Set("rp", is.config.RetentionPolicy)
+	}
+	return base + "/write?" + params.Encode()
+}
+
+func (is *InfluxSink) loadFallback() []string {
+	if is.config.FallbackFile == "" {
+		return nil
+	}
+	body, err := ioutil.ReadFile(is.config.FallbackFile)
+	if err != nil {
+		return nil
+	}
+	var lines []string
+	for _, line := range strings.Split(string(body), "\n") {
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return is.limitFallback(lines)
+}
+
+// saveFallback adds lines to fallback file. The file is rewritten , so it's kept within age and size limits.
+func (is *InfluxSink) saveFallback(lines []string) {
+	if is.config.FallbackFile == "" || len(lines) == 0 {
+		if len(lines) > 0 {
+			log.Warnf("<Influx> %d lines dropped", len(lines))
+		}
+		return
+	}
+	lines = append(is.loadFallback(), lines...)
+	lines = is.limitFallback(lines)
+	f, err := os.Create(is.config.FallbackFile)
+	if err != nil {
+		log.Error("<Influx> Can't open fallback file : ", err)
+		return
+	}
+	defer f.Close()
+	f.WriteString(strings.Join(lines, "\n") + "\n")
+}
+
+// limitFallback drops lines older than max age and the oldest lines over max number of lines.
+// Age is taken from timestamp of the line , lines are in order they were read.
+func (is *InfluxSink) limitFallback(lines []string) []string {
+	minTime := time.Now().Add(-time.Duration(is.config.FallbackMaxAge) * time.Second).UnixNano()
+	i := 0
+	for i < len(lines) && lineTimestamp(lines[i]) < minTime {
+		i++
+	}
+	if len(lines)-i > is.config.FallbackMaxLines {
+		i = len(lines) - is.config.FallbackMaxLines
+	}
+	if i > 0 {
+		log.Warnf("<Influx> %d lines dropped from fallback file", i)
+	}
+	return lines[i:]
+}
+
+// lineTimestamp returns timestamp in nanoseconds , it's the last element of the line.
+func lineTimestamp(line string) int64 {
+	ts, err := strconv.ParseInt(line[strings.LastIndex(line, " ")+1:], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return ts
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// influxStandIn records write requests and answers them with configured status.
+type influxStandIn struct {
+	lock     sync.Mutex
+	status   int
+	requests []*http.Request
+	bodies   []string
+}
+
+func (s *influxStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.requests = append(s.requests, r)
+	s.bodies = append(s.bodies, string(body))
+	w.WriteHeader(s.status)
+}
+
+func (s *influxStandIn) setStatus(status int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.status = status
+}
+
+func newTestInfluxSink(config InfluxConfig) *InfluxSink {
+	config.FlushInterval = 3600
+	is := NewInfluxSink(config)
+	is.retryDelay = time.Millisecond
+	return is
+}
+
+func testReading() *DeviceReading {
+	reading := NewDeviceReading("C4:7C:8D:6A:3E:8B", "miflora")
+	reading.Alias = "living room"
+	reading.Time = time.Unix(1500000000, 0)
+	reading.Add("sensor_temp", 21.5, "C")
+	reading.Add("sensor_lumin", 120, "Lux")
+	reading.SetBattery(97)
+	reading.SetRssi(-70)
+	return reading
+}
+
+func TestInfluxLineProtocol(t *testing.T) {
+	is := newTestInfluxSink(InfluxConfig{URL: "http://localhost"})
+	expected := "ble_sensor,mac=C4:7C:8D:6A:3E:8B,alias=living\\ room,type=miflora battery=97i,rssi=-70i,sensor_lumin=120,sensor_temp=21.5 1500000000000000000"
+	if line := is.lineProtocol(testReading()); line != expected {
+		t.Errorf("unexpected line\n got  %s\n want %s", line, expected)
+	}
+	if line := is.lineProtocol(NewDeviceReading("C4:7C:8D:6A:3E:8B", "miflora")); line != "" {
+		t.Errorf("reading without values produced line %s", line)
+	}
+}
+
+func TestInfluxWriteV1(t *testing.T) {
+	standIn := &influxStandIn{status: http.StatusNoContent}
+	server := httptest.NewServer(standIn)
+	defer server.Close()
+	is := newTestInfluxSink(InfluxConfig{URL: server.URL + "/", Database: "sensors", RetentionPolicy: "month", Username: "user", Password: "secret"})
+	is.PublishReading(testReading())
+	is.Flush()
+
+	if len(standIn.requests) != 1 {
+		t.Fatalf("expected 1 request , got %d", len(standIn.requests))
+	}
+	r := standIn.requests[0]
+	if r.Method != "POST" || r.URL.Path != "/write" {
+		t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+	}
+	query := r.URL.Query()
+	if query.Get("db") != "sensors" || query.Get("rp") != "month" || query.Get("precision") != "ns" {
+		t.Errorf("unexpected query %s", r.URL.RawQuery)
+	}
+	if user, password, ok := r.BasicAuth(); !ok || user != "user" || password != "secret" {
+		t.Errorf("unexpected basic auth %s:%s", user, password)
+	}
+	if standIn.bodies[0] != is.lineProtocol(testReading()) {
+		t.Errorf("unexpected body %s", standIn.bodies[0])
+	}
+}
+
+func TestInfluxWriteV2(t *testing.T) {
+	standIn := &influxStandIn{status: http.StatusNoContent}
+	server := httptest.NewServer(standIn)
+	defer server.Close()
+	is := newTestInfluxSink(InfluxConfig{URL: server.URL, Version: 2, Org: "home", Bucket: "plants", Token: "abc"})
+	is.PublishReading(testReading())
+	is.Flush()
+
+	if len(standIn.requests) != 1 {
+		t.Fatalf("expected 1 request , got %d", len(standIn.requests))
+	}
+	r := standIn.requests[0]
+	if r.URL.Path != "/api/v2/write" {
+		t.Errorf("unexpected path %s", r.URL.Path)
+	}
+	if query := r.URL.Query(); query.Get("org") != "home" || query.Get("bucket") != "plants" || query.Get("db") != "" {
+		t.Errorf("unexpected query %s", r.URL.RawQuery)
+	}
+	if auth := r.Header.Get("Authorization"); auth != "Token abc" {
+		t.Errorf("unexpected authorization %s", auth)
+	}
+}
+
+func TestInfluxRetryAndFallback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "influx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fallback := filepath.Join(dir, "fallback.txt")
+	standIn := &influxStandIn{status: http.StatusServiceUnavailable}
+	server := httptest.NewServer(standIn)
+	defer server.Close()
+	is := newTestInfluxSink(InfluxConfig{URL: server.URL, Database: "sensors", MaxRetries: 2, FallbackFile: fallback})
+
+	first := testReading()
+	first.Time = time.Now().Add(-time.Hour)
+	is.PublishReading(first)
+	is.Flush()
+	if len(standIn.requests) != 2 {
+		t.Errorf("expected 2 attempts , got %d", len(standIn.requests))
+	}
+	body, err := ioutil.ReadFile(fallback)
+	if err != nil || strings.TrimSpace(string(body)) != is.lineProtocol(first) {
+		t.Fatalf("line wasn't saved to fallback file : %q %v", body, err)
+	}
+
+	standIn.setStatus(http.StatusNoContent)
+	second := testReading()
+	second.Time = first.Time.Add(time.Minute)
+	is.PublishReading(second)
+	is.Flush()
+	if len(standIn.bodies) != 4 {
+		t.Fatalf("expected fallback and new batch to be written , got %d requests", len(standIn.bodies))
+	}
+	if standIn.bodies[2] != is.lineProtocol(first) || standIn.bodies[3] != is.lineProtocol(second) {
+		t.Errorf("unexpected order of writes : %v", standIn.bodies[2:])
+	}
+	if _, err := os.Stat(fallback); !os.IsNotExist(err) {
+		t.Error("fallback file wasn't removed")
+	}
+}
+
+func TestInfluxRejectedBatchIsNotRetried(t *testing.T) {
+	dir, err := ioutil.TempDir("", "influx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fallback := filepath.Join(dir, "fallback.txt")
+	standIn := &influxStandIn{status: http.StatusBadRequest}
+	server := httptest.NewServer(standIn)
+	defer server.Close()
+	is := newTestInfluxSink(InfluxConfig{URL: server.URL, Database: "sensors", MaxRetries: 3, FallbackFile: fallback})
+	is.PublishReading(testReading())
+	is.Flush()
+	if len(standIn.requests) != 1 {
+		t.Errorf("expected 1 attempt , got %d", len(standIn.requests))
+	}
+	if _, err := os.Stat(fallback); !os.IsNotExist(err) {
+		t.Error("rejected lines were saved to fallback file")
+	}
+}
+
+func TestInfluxFallbackLimits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "influx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fallback := filepath.Join(dir, "fallback.txt")
+	standIn := &influxStandIn{status: http.StatusServiceUnavailable}
+	server := httptest.NewServer(standIn)
+	defer server.Close()
+	is := newTestInfluxSink(InfluxConfig{URL: server.URL, Database: "sensors", MaxRetries: 1, FallbackFile: fallback, FallbackMaxLines: 3, FallbackMaxAge: 3600})
+
+	now := time.Now()
+	var lines []string
+	// the first reading is older than max age , the rest doesn't fit into max number of lines
+	for _, age := range []time.Duration{2 * time.Hour, 50 * time.Minute, 40 * time.Minute, 30 * time.Minute, 20 * time.Minute, 10 * time.Minute} {
+		reading := testReading()
+		reading.Time = now.Add(-age)
+		lines = append(lines, is.lineProtocol(reading))
+		is.PublishReading(reading)
+		is.Flush()
+	}
+	body, err := ioutil.ReadFile(fallback)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := strings.Join(lines[3:], "\n")
+	if saved := strings.TrimSpace(string(body)); saved != expected {
+		t.Errorf("expected the newest lines in fallback file :\n%s\ngot :\n%s", expected, saved)
+	}
+
+	// lines which expired while the file was waiting aren't written
+	is.config.FallbackMaxAge = 15 * 60
+	standIn.setStatus(http.StatusNoContent)
+	standIn.lock.Lock()
+	standIn.bodies = nil
+	standIn.lock.Unlock()
+	is.Flush()
+	if len(standIn.bodies) != 1 || standIn.bodies[0] != lines[5] {
+		t.Errorf("expected only the newest line to be written , got %q", standIn.bodies)
+	}
+}
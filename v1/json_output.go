@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+type jsonReading struct {
+	Mac       string             `json:"mac"`
+	Alias     string             `json:"alias"`
+	Type      string             `json:"type"`
+	Values    map[string]float64 `json:"values"`
+	Rssi      *int               `json:"rssi,omitempty"`
+	Battery   *int               `json:"battery,omitempty"`
+	Timestamp int64              `json:"timestamp"` // unix time in seconds
+}
+
+// JsonSink publishes flat JSON document per reading , for simple consumers like Node-RED.
+type JsonSink struct {
+	topicTemplate string
+	retain        bool
+	qos           byte
+	transport     FimpTransport
+}
+
+func NewJsonSink(topicTemplate string, retain bool, qos byte, transport FimpTransport) *JsonSink {
+	return &JsonSink{topicTemplate: topicTemplate, retain: retain, qos: qos, transport: transport}
+}
+
+func (js *JsonSink) Name() string {
+	return "json"
+}
+
+// topicLevelReplacer replaces characters which have special meaning in MQTT topic.
+var topicLevelReplacer = strings.NewReplacer("/", "_", "+", "_", "#", "_")
+
+// topic expands {alias} , {mac} and {type} placeholders. Mac is used instead of alias if the device has none.
+// Alias is inserted as single topic level , so it can't change topic structure or make it a wildcard.
+func (js *JsonSink) topic(reading *DeviceReading) string {
+	mac := strings.ToLower(strings.Replace(reading.Address, ":", "", -1))
+	alias := topicLevelReplacer.Replace(strings.TrimSpace(reading.Alias))
+	if alias == "" {
+		alias = mac
+	}
+	r := strings.NewReplacer("{alias}", alias, "{mac}", mac, "{type}", reading.Type)
+	return r.Replace(js.topicTemplate)
+}
+
+func (js *JsonSink) PublishReading(reading *DeviceReading) {
+	doc := jsonReading{
+		Mac:       reading.Address,
+		Alias:     reading.Alias,
+		Type:      reading.Type,
+		Values:    map[string]float64{},
+		Timestamp: reading.Time.Unix(),
+	}
+	for _, v := range reading.Values {
+		doc.Values[v.Service] = v.Value
+	}
+	if reading.HasRssi {
+		rssi := reading.Rssi
+		doc.Rssi = &rssi
+	}
+	if reading.HasBattery {
+		battery := reading.Battery
+		doc.Battery = &battery
+	}
+	body, _ := json.Marshal(doc)
+	if err := js.transport.PublishRaw(js.topic(reading), body, js.qos, js.retain); err != nil {
+		log.Error("<Json> Can't publish reading : ", err)
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestJsonSinkTopic(t *testing.T) {
+	cases := []struct {
+		template string
+		alias    string
+		expected string
+	}{
+		{"ble/{alias}/state", "ficus", "ble/ficus/state"},
+		{"ble/{alias}/state", "", "ble/c47c8d6a3e8b/state"},
+		{"ble/{alias}/state", "  ficus ", "ble/ficus/state"},
+		{"ble/{alias}/state", "   ", "ble/c47c8d6a3e8b/state"},
+		{"ble/{alias}/state", "living/room", "ble/living_room/state"},
+		{"ble/{alias}/state", "#1 + spare", "ble/_1 _ spare/state"},
+		{"ble/{type}/{mac}", "ficus", "ble/miflora/c47c8d6a3e8b"},
+	}
+	for _, c := range cases {
+		js := NewJsonSink(c.template, false, 0, &captureTransport{})
+		reading := NewDeviceReading(testDeviceAddr, "miflora")
+		reading.Alias = c.alias
+		if topic := js.topic(reading); topic != c.expected {
+			t.Errorf("alias %q : expected %s , got %s", c.alias, c.expected, topic)
+		}
+	}
+}
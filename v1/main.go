@@ -2,17 +2,30 @@ package main
 
 import (
 "os"
-
-	"fmt"
 )
 
 func main() {
-	configPath := os.Args[1]
-	fmt.Printf("Loading config from : %s \n",configPath )
-
-	ad := NewMifloraAd(configPath)
-	ad.Start()
-	select{}
+	if len(os.Args) < 2 {
+		printUsage()
+		os.Exit(2)
+	}
+	switch os.Args[1] {
+	case "run":
+		runCommand(os.Args[2:])
+	case "scan":
+		scanCommand(os.Args[2:])
+	case "read":
+		readCommand(os.Args[2:])
+	case "config":
+		configCommand(os.Args[2:])
+	case "devices":
+		devicesCommand(os.Args[2:])
+	case "help", "-h", "--help":
+		printUsage()
+	default:
+		// old style , config path is the only argument
+		runAdapter(os.Args[1])
+	}
 
 }
 
@@ -20,5 +33,3 @@ func main() {
 //func readConfig() {
 //
 //}
-
-
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "blead"
+
+var (
+	metricSensorValue = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace, Name: "sensor_value", Help: "Last known sensor value.",
+	}, []string{"mac", "alias", "service", "unit"})
+	metricBattery = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace, Name: "battery_percent", Help: "Last known battery level.",
+	}, []string{"mac", "alias"})
+	metricRssi = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace, Name: "rssi_dbm", Help: "Last known RSSI of the device.",
+	}, []string{"mac", "alias"})
+	metricLastSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace, Name: "last_success_timestamp_seconds", Help: "Time of last successful read.",
+	}, []string{"mac", "alias"})
+	metricReadsAttempted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace, Name: "reads_attempted_total", Help: "Number of device reads.",
+	}, []string{"adapter"})
+	metricReadsFailed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace, Name: "reads_failed_total", Help: "Number of device reads which failed after all retries.",
+	}, []string{"adapter"})
+	metricReadRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace, Name: "read_retries_total", Help: "Number of sensor read retries.",
+	}, []string{"adapter"})
+	metricGattLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace, Name: "gatt_operation_duration_seconds", Help: "Duration of GATT operations.",
+		Buckets: []float64{0.25, 0.5, 1, 2, 4, 8, 16, 32},
+	}, []string{"adapter", "operation"})
+	metricRejectedValues = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace, Name: "rejected_values_total", Help: "Number of values dropped by plausibility filter.",
+	}, []string{"service", "reason"})
+	metricUndeclaredEvents = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace, Name: "undeclared_events_total", Help: "Number of published events which don't match declared services.",
+	})
+	metricMqttPublishErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace, Name: "mqtt_publish_errors_total", Help: "Number of failed MQTT publishes.",
+	})
+)
+
+// startMetricsServer registers collectors and serves /metrics for Prometheus.
+func (mg *MiFloraAd) startMetricsServer() {
+	prometheus.MustRegister(metricSensorValue, metricBattery, metricRssi, metricLastSuccess,
+		metricReadsAttempted, metricReadsFailed, metricReadRetries, metricGattLatency, metricMqttPublishErrors, metricRejectedValues, metricUndeclaredEvents)
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace, Name: "offline_queue_size", Help: "Number of events waiting for broker connection.",
+	}, func() float64 { return float64(mg.offlineQueue.Len()) }))
+	prometheus.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: metricsNamespace, Name: "offline_queue_dropped_total", Help: "Number of events dropped from offline queue.",
+	}, func() float64 { return float64(mg.offlineQueue.Dropped()) }))
+	for _, name := range mg.adapterNames {
+		adapter := mg.adapters[name]
+		prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace, Name: "adapter_job_queue_size", Help: "Number of read jobs waiting for adapter.",
+			ConstLabels: prometheus.Labels{"adapter": name},
+		}, func() float64 { return float64(len(adapter.jobs)) }))
+		prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace, Name: "adapter_up", Help: "1 if adapter is up.",
+			ConstLabels: prometheus.Labels{"adapter": name},
+		}, func() float64 {
+			if mg.adapterState(adapter) == AdapterStateUp {
+				return 1
+			}
+			return 0
+		}))
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	go func() {
+		log.Info("<Ad> Metrics are served on ", mg.config.MetricsListenAddress)
+		if err := http.ListenAndServe(mg.config.MetricsListenAddress, mux); err != nil {
+			log.Error("<Ad> Metrics server stopped : ", err)
+		}
+	}()
+}
+
+// MetricsSink keeps last known readings as Prometheus gauges.
+type MetricsSink struct{}
+
+func (ms *MetricsSink) Name() string {
+	return "metrics"
+}
+
+func (ms *MetricsSink) PublishReading(reading *DeviceReading) {
+	for _, v := range reading.Values {
+		metricSensorValue.WithLabelValues(reading.Address, reading.Alias, v.Service, v.Unit).Set(v.Value)
+	}
+	if reading.HasBattery {
+		metricBattery.WithLabelValues(reading.Address, reading.Alias).Set(float64(reading.Battery))
+	}
+	if reading.HasRssi {
+		metricRssi.WithLabelValues(reading.Address, reading.Alias).Set(float64(reading.Rssi))
+	}
+	if len(reading.Values) > 0 {
+		metricLastSuccess.WithLabelValues(reading.Address, reading.Alias).Set(float64(reading.Time.Unix()))
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/alivinco/fimpgo"
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+)
+
+const publishTimeout = 5 * time.Second
+
+// FimpTransport publishes messages of the adapter and outputs , it's implemented by MqttTransport.
+type FimpTransport interface {
+	Publish(addr *fimpgo.Address, fimpMsg *fimpgo.FimpMessage) error
+	PublishRaw(topic string, payload []byte, qos byte, retain bool) error
+	IsConnected() bool
+	IsTls() bool
+	AddGlobalPrefix(topic string) string
+}
+
+// MqttTransportConfig is everything needed to open broker connection.
+type MqttTransportConfig struct {
+	ServerURI          string
+	ClientID           string
+	Username           string
+	Password           string
+	CaFile             string // CA bundle used to verify broker certificate
+	ClientCertFile     string // client certificate for mutual TLS
+	ClientKeyFile      string
+	InsecureSkipVerify bool // only for lab setups with self-signed broker certificate
+	WillTopic          string
+	WillPayload        []byte
+	SubQos             byte
+	PubQos             byte
+}
+
+// MqttTransport is FIMP transport on top of paho client. Unlike fimpgo.MqttTransport it exposes TLS and last-will
+// settings , connection state and raw publishing with retain flag , which are needed by the adapter.
+type MqttTransport struct {
+	client        MQTT.Client
+	config        MqttTransportConfig
+	globalPrefix  string
+	subscriptions []string
+	msgHandler    fimpgo.MessageHandler
+	onConnect     func()
+}
+
+func NewMqttTransport(config MqttTransportConfig) (*MqttTransport, error) {
+	mh := &MqttTransport{config: config}
+	opts := MQTT.NewClientOptions().AddBroker(config.ServerURI)
+	opts.SetClientID(config.ClientID)
+	opts.SetUsername(config.Username)
+	opts.SetPassword(config.Password)
+	opts.SetCleanSession(true)
+	opts.SetAutoReconnect(true)
+	opts.SetKeepAlive(30 * time.Second)
+	opts.SetConnectionLostHandler(mh.onConnectionLost)
+	opts.SetOnConnectHandler(mh.onConnected)
+	if config.WillTopic != "" {
+		opts.SetBinaryWill(config.WillTopic, config.WillPayload, 1, true)
+	}
+	if !isTlsURI(config.ServerURI) && (config.CaFile != "" || config.ClientCertFile != "" || config.ClientKeyFile != "") {
+		// paho uses TLS config only for ssl:// , tls:// and wss:// brokers
+		log.Warnf("<Mqtt> Certificate files are ignored , %s doesn't use TLS", config.ServerURI)
+	}
+	if isTlsURI(config.ServerURI) || config.CaFile != "" || config.ClientCertFile != "" {
+		tlsConfig, err := newTlsConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		opts.SetTLSConfig(tlsConfig)
+	}
+	mh.client = MQTT.NewClient(opts)
+	return mh, nil
+}
+
+func isTlsURI(uri string) bool {
+	return strings.HasPrefix(uri, "ssl://") || strings.HasPrefix(uri, "tls://") || strings.HasPrefix(uri, "wss://")
+}
+
+func newTlsConfig(config MqttTransportConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.InsecureSkipVerify}
+	if config.CaFile != "" {
+		caBody, err := ioutil.ReadFile(config.CaFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caBody) {
+			return nil, fmt.Errorf("no certificates found in %s", config.CaFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if config.ClientCertFile != "" || config.ClientKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.ClientCertFile, config.ClientKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if config.InsecureSkipVerify {
+		log.Warn("<Mqtt> Broker certificate verification is disabled")
+	}
+	return tlsConfig, nil
+}
+
+// IsTls returns true if connection to broker is encrypted.
+func (mh *MqttTransport) IsTls() bool {
+	return isTlsURI(mh.config.ServerURI)
+}
+
+func (mh *MqttTransport) SetGlobalTopicPrefix(prefix string) {
+	mh.globalPrefix = prefix
+}
+
+func (mh *MqttTransport) SetMessageHandler(msgHandler fimpgo.MessageHandler) {
+	mh.msgHandler = msgHandler
+}
+
+// SetOnConnectHandler sets callback which is invoked after every successful (re)connect.
+func (mh *MqttTransport) SetOnConnectHandler(onConnect func()) {
+	mh.onConnect = onConnect
+}
+
+func (mh *MqttTransport) Start() error {
+	token := mh.client.Connect()
+	if token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+	return nil
+}
+
+func (mh *MqttTransport) Stop() {
+	mh.client.Disconnect(250)
+}
+
+func (mh *MqttTransport) IsConnected() bool {
+	return mh.client.IsConnected()
+}
+
+// AddGlobalPrefix adds global prefix to topic.
+func (mh *MqttTransport) AddGlobalPrefix(topic string) string {
+	return addGlobalPrefix(mh.globalPrefix, topic)
+}
+
+func addGlobalPrefix(prefix string, topic string) string {
+	if prefix == "" {
+		return topic
+	}
+	return strings.TrimSuffix(prefix, "/") + "/" + topic
+}
+
+func (mh *MqttTransport) Subscribe(topic string) error {
+	mh.subscriptions = append(mh.subscriptions, topic)
+	if !mh.client.IsConnected() {
+		// will be subscribed on connect
+		return nil
+	}
+	return mh.subscribe(topic)
+}
+
+func (mh *MqttTransport) subscribe(topic string) error {
+	token := mh.client.Subscribe(mh.AddGlobalPrefix(topic), mh.config.SubQos, mh.onMessage)
+	if token.Wait() && token.Error() != nil {
+		log.Errorf("<Mqtt> Can't subscribe to %s : %s", topic, token.Error())
+		return token.Error()
+	}
+	return nil
+}
+
+// Publish serializes FIMP message and publishes it to topic derived from address.
+func (mh *MqttTransport) Publish(addr *fimpgo.Address, fimpMsg *fimpgo.FimpMessage) error {
+	body, err := fimpMsg.SerializeToJson()
+	if err != nil {
+		return err
+	}
+	return mh.PublishRaw(mh.AddGlobalPrefix(addr.Serialize()), body, mh.config.PubQos, false)
+}
+
+// PublishRaw publishes payload to topic as is , global prefix is not added.
+// Error means the message wasn't sent and won't be , so the caller can keep it in offline queue.
+func (mh *MqttTransport) PublishRaw(topic string, payload []byte, qos byte, retain bool) error {
+	// IsConnected is true also while client is reconnecting , publishing would block until timeout
+	if !mh.client.IsConnectionOpen() {
+		metricMqttPublishErrors.Inc()
+		return errors.New("not connected to broker")
+	}
+	token := mh.client.Publish(topic, qos, retain, payload)
+	if !token.WaitTimeout(publishTimeout) {
+		if qos > 0 {
+			// message is stored by the client and resent after reconnect , it mustn't be queued again
+			log.Warn("<Mqtt> Publish to ", topic, " isn't confirmed yet , it will be resent by client")
+			return nil
+		}
+		metricMqttPublishErrors.Inc()
+		return errors.New("publish timeout")
+	}
+	if token.Error() != nil {
+		metricMqttPublishErrors.Inc()
+	}
+	return token.Error()
+}
+
+func (mh *MqttTransport) onMessage(client MQTT.Client, msg MQTT.Message) {
+	topic := msg.Topic()
+	if mh.globalPrefix != "" {
+		topic = strings.TrimPrefix(topic, strings.TrimSuffix(mh.globalPrefix, "/")+"/")
+	}
+	addr, err := fimpgo.NewAddressFromString(topic)
+	if err != nil {
+		log.Debug("<Mqtt> Can't parse topic ", msg.Topic())
+		return
+	}
+	fimpMsg, err := fimpgo.NewMessageFromBytes(msg.Payload())
+	if err != nil {
+		log.Debug("<Mqtt> Can't parse message : ", err)
+		return
+	}
+	if mh.msgHandler != nil {
+		mh.msgHandler(topic, addr, fimpMsg, msg.Payload())
+	}
+}
+
+func (mh *MqttTransport) onConnected(client MQTT.Client) {
+	log.Info("<Mqtt> Connected to broker")
+	for _, topic := range mh.subscriptions {
+		mh.subscribe(topic)
+	}
+	if mh.onConnect != nil {
+		go mh.onConnect()
+	}
+}
+
+func (mh *MqttTransport) onConnectionLost(client MQTT.Client, err error) {
+	log.Error("<Mqtt> Connection to broker lost : ", err)
+}
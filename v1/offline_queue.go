@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/alivinco/fimpgo"
+)
+
+const defaultOfflineQueueMaxSize = 5000
+const defaultOfflineQueueMaxAge = 172800 // seconds , 2 days
+const offlineQueueFlushInterval = 10 * time.Second
+
+type queuedEvent struct {
+	Topic    string          `json:"topic"`
+	Msg      json.RawMessage `json:"msg"`
+	QueuedAt time.Time       `json:"queued_at"`
+}
+
+// OfflineQueue keeps FIMP events which couldn't be published while broker was unreachable.
+// Events are stored as serialized messages, so the original creation time is kept on replay.
+type OfflineQueue struct {
+	file    string
+	maxSize int
+	maxAge  time.Duration
+	events  []queuedEvent
+	dropped int
+	lines   int // lines in file , it can contain events which were already dropped from memory
+	lock    sync.Mutex
+}
+
+func NewOfflineQueue(file string, maxSize int, maxAge int) *OfflineQueue {
+	if maxSize == 0 {
+		maxSize = defaultOfflineQueueMaxSize
+	}
+	if maxAge == 0 {
+		maxAge = defaultOfflineQueueMaxAge
+	}
+	q := &OfflineQueue{file: file, maxSize: maxSize, maxAge: time.Duration(maxAge) * time.Second}
+	q.load()
+	return q
+}
+
+func (q *OfflineQueue) load() {
+	f, err := os.Open(q.file)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var ev queuedEvent
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err == nil {
+			q.events = append(q.events, ev)
+		}
+		q.lines++
+	}
+	q.expire()
+	if len(q.events) > q.maxSize {
+		q.dropped += len(q.events) - q.maxSize
+		q.events = q.events[len(q.events)-q.maxSize:]
+	}
+	log.Infof("<Queue> Loaded %d queued events from %s", len(q.events), q.file)
+}
+
+// save rewrites queue file , only events which are still queued are kept. Must be called with lock held.
+func (q *OfflineQueue) save() {
+	q.lines = len(q.events)
+	f, err := os.Create(q.file)
+	if err != nil {
+		log.Error("<Queue> Can't save offline queue : ", err)
+		return
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	for _, ev := range q.events {
+		line, _ := json.Marshal(ev)
+		w.Write(line)
+		w.WriteString("\n")
+	}
+	w.Flush()
+}
+
+// appendToFile adds event to the end of queue file. Must be called with lock held.
+func (q *OfflineQueue) appendToFile(ev queuedEvent) {
+	f, err := os.OpenFile(q.file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		log.Error("<Queue> Can't save offline queue : ", err)
+		return
+	}
+	defer f.Close()
+	line, _ := json.Marshal(ev)
+	f.Write(append(line, '\n'))
+	q.lines++
+}
+
+// expire drops events which are older than max age. Must be called with lock held.
+func (q *OfflineQueue) expire() {
+	i := 0
+	for i < len(q.events) && time.Since(q.events[i].QueuedAt) > q.maxAge {
+		i++
+	}
+	if i > 0 {
+		q.dropped += i
+		log.Warnf("<Queue> %d events expired", i)
+		q.events = q.events[i:]
+	}
+}
+
+func (q *OfflineQueue) Add(addr *fimpgo.Address, msg *fimpgo.FimpMessage) {
+	body, err := msg.SerializeToJson()
+	if err != nil {
+		return
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.expire()
+	if len(q.events) >= q.maxSize {
+		// the oldest event is dropped to make room for the new one
+		q.events = q.events[1:]
+		q.dropped++
+		log.Warn("<Queue> Offline queue is full , oldest event dropped")
+	}
+	ev := queuedEvent{Topic: addr.Serialize(), Msg: body, QueuedAt: time.Now()}
+	q.events = append(q.events, ev)
+	if q.lines >= 2*q.maxSize {
+		// file is compacted only when dropped events take too much space
+		q.save()
+	} else {
+		q.appendToFile(ev)
+	}
+}
+
+// Flush publishes queued events in order and stops at first failure.
+func (q *OfflineQueue) Flush(transport FimpTransport) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.expire()
+	if len(q.events) == 0 {
+		return nil
+	}
+	var err error
+	sent := 0
+	for _, ev := range q.events {
+		var addr *fimpgo.Address
+		var msg *fimpgo.FimpMessage
+		addr, err = fimpgo.NewAddressFromString(ev.Topic)
+		if err == nil {
+			msg, err = fimpgo.NewMessageFromBytes(ev.Msg)
+		}
+		if err != nil {
+			log.Error("<Queue> Corrupted event dropped : ", err)
+			q.dropped++
+			sent++
+			err = nil
+			continue
+		}
+		if err = transport.Publish(addr, msg); err != nil {
+			break
+		}
+		sent++
+	}
+	q.events = q.events[sent:]
+	q.save()
+	log.Infof("<Queue> Replayed %d events , %d left", sent, len(q.events))
+	return err
+}
+
+func (q *OfflineQueue) Len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return len(q.events)
+}
+
+// Dropped returns number of events lost because of size or age limits.
+func (q *OfflineQueue) Dropped() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.dropped
+}
+
+// publishEvent publishes sensor event , or stores it in offline queue if the broker is not reachable.
+// Once something is queued , new events are queued as well to keep the order.
+func (mg *MiFloraAd) publishEvent(addr *fimpgo.Address, msg *fimpgo.FimpMessage) {
+	mg.checkDeclaredEvent(addr, msg)
+	if mg.offlineQueue.Len() == 0 {
+		err := mg.msgTransport.Publish(addr, msg)
+		if err == nil {
+			return
+		}
+		log.Warn("<Ad> Publish failed , event is queued : ", err)
+	}
+	mg.offlineQueue.Add(addr, msg)
+}
+
+func (mg *MiFloraAd) flushOfflineQueue() {
+	for {
+		time.Sleep(offlineQueueFlushInterval)
+		if mg.offlineQueue.Len() > 0 {
+			mg.offlineQueue.Flush(mg.msgTransport)
+		}
+	}
+}
+
+func (mg *MiFloraAd) SendQueueReport() {
+	report := map[string]string{
+		"size":    strconv.Itoa(mg.offlineQueue.Len()),
+		"dropped": strconv.Itoa(mg.offlineQueue.Dropped()),
+	}
+	msg := fimpgo.NewStrMapMessage("evt.queue.report", "ble", report, nil, nil, nil)
+	fimpAddr, _ := fimpgo.NewAddressFromString("pt:j1/mt:evt/rt:ad/rn:ble/ad:1")
+	mg.msgTransport.Publish(fimpAddr, msg)
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/alivinco/fimpgo"
+)
+
+// PlantProfile describes conditions the plant needs. Unset limits are not checked.
+type PlantProfile struct {
+	Name            string
+	MinMoisture     *float64 // %
+	MaxMoisture     *float64
+	MinConductivity *float64 // µS/cm
+	MaxConductivity *float64
+	MinLight        *float64 // lux , compared with brightest reading of the day when the day is over
+	MaxLight        *float64
+	MinTemp         *float64 // C
+	MaxTemp         *float64
+	Hysteresis      float64 // percent of min-max range the value has to return by before alarm is cleared , 5 by default
+}
+
+// plantDbEntry is a record of plant database export , for instance from Flower care app.
+type plantDbEntry struct {
+	Pid          string   `json:"pid"`
+	DisplayPid   string   `json:"display_pid"`
+	MinLightLux  *float64 `json:"min_light_lux"`
+	MaxLightLux  *float64 `json:"max_light_lux"`
+	MinTemp      *float64 `json:"min_temp"`
+	MaxTemp      *float64 `json:"max_temp"`
+	MinSoilMoist *float64 `json:"min_soil_moist"`
+	MaxSoilMoist *float64 `json:"max_soil_moist"`
+	MinSoilEc    *float64 `json:"min_soil_ec"`
+	MaxSoilEc    *float64 `json:"max_soil_ec"`
+}
+
+// LoadPlantDatabase reads JSON array of plant database records. Profiles are keyed by lower case pid.
+func LoadPlantDatabase(path string) (map[string]PlantProfile, error) {
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries []plantDbEntry
+	if err := json.Unmarshal(body, &entries); err != nil {
+		return nil, err
+	}
+	profiles := map[string]PlantProfile{}
+	for _, e := range entries {
+		name := e.DisplayPid
+		if name == "" {
+			name = e.Pid
+		}
+		profiles[strings.ToLower(e.Pid)] = PlantProfile{
+			Name:        name,
+			MinMoisture: e.MinSoilMoist, MaxMoisture: e.MaxSoilMoist,
+			MinConductivity: e.MinSoilEc, MaxConductivity: e.MaxSoilEc,
+			MinLight: e.MinLightLux, MaxLight: e.MaxLightLux,
+			MinTemp: e.MinTemp, MaxTemp: e.MaxTemp,
+		}
+	}
+	return profiles, nil
+}
+
+// loadPlantProfiles merges plant database with profiles from config , config profiles win.
+// Relative path of plant database is resolved against config file directory.
+func loadPlantProfiles(configPath string, config MifloraConfig) (map[string]PlantProfile, error) {
+	profiles := map[string]PlantProfile{}
+	var err error
+	if config.PlantDatabaseFile != "" {
+		profiles, err = LoadPlantDatabase(configRelativePath(configPath, config.PlantDatabaseFile))
+		if err != nil {
+			profiles = map[string]PlantProfile{}
+		}
+	}
+	for name, p := range config.PlantProfiles {
+		profiles[strings.ToLower(name)] = p
+	}
+	return profiles, err
+}
+
+// plantLimit is one checked limit of a plant profile.
+type plantLimit struct {
+	service   string
+	min       *float64
+	max       *float64
+	lowEvent  string
+	highEvent string
+}
+
+func (p PlantProfile) limits() []plantLimit {
+	return []plantLimit{
+		{"sensor_moist", p.MinMoisture, p.MaxMoisture, "needs_water", "too_wet"},
+		{"sensor_conduct", p.MinConductivity, p.MaxConductivity, "needs_fertilizer", "too_much_fertilizer"},
+		{"sensor_temp", p.MinTemp, p.MaxTemp, "too_cold", "too_hot"},
+		// too little light can be told only at the end of the day
+		{"sensor_lumin", nil, p.MaxLight, "", "too_bright"},
+	}
+}
+
+// hysteresis returns distance from the limit the value has to return by before alarm is cleared.
+func (p PlantProfile) hysteresis(limit plantLimit) float64 {
+	percent := p.Hysteresis
+	if percent == 0 {
+		percent = 5
+	}
+	if limit.min != nil && limit.max != nil {
+		return (*limit.max - *limit.min) * percent / 100
+	}
+	if limit.min != nil {
+		return math.Abs(*limit.min) * percent / 100
+	}
+	if limit.max != nil {
+		return math.Abs(*limit.max) * percent / 100
+	}
+	return 0
+}
+
+type plantState struct {
+	alarms   map[string]bool // event -> active
+	day      string
+	dli      float64 // mol/m2 collected since the start of the day
+	maxLux   float64
+	lastLux  float64
+	lastTime time.Time
+}
+
+// dliUnit is FIMP unit of sensor_dli , outputs with own unit tables show it as mol/m²/d
+const dliUnit = "mol/m2/d"
+
+// luxToPpfd converts illuminance to photosynthetic photon flux density (µmol/m2/s) , sunlight approximation.
+const luxToPpfd = 0.0185
+
+// maxDliGap limits interval between two light readings which is integrated , longer gaps are not counted.
+const maxDliGap = time.Hour
+
+// PlantCare tracks plant alarms and daily light integral of devices with plant profile.
+type PlantCare struct {
+	profiles map[string]PlantProfile
+	lock     sync.Mutex
+	states   map[string]*plantState
+}
+
+func NewPlantCare(profiles map[string]PlantProfile) *PlantCare {
+	return &PlantCare{profiles: profiles, states: map[string]*plantState{}}
+}
+
+func (pc *PlantCare) Profile(name string) (PlantProfile, bool) {
+	p, ok := pc.profiles[strings.ToLower(name)]
+	return p, ok
+}
+
+// plantAlarm is alarm state change.
+type plantAlarm struct {
+	event  string
+	active bool
+}
+
+// Update adds daily light integral to the reading and returns alarms which changed state.
+func (pc *PlantCare) Update(reading *DeviceReading, profile PlantProfile) []plantAlarm {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+	state := pc.states[reading.Address]
+	if state == nil {
+		state = &plantState{alarms: map[string]bool{}}
+		pc.states[reading.Address] = state
+	}
+	var changes []plantAlarm
+	setAlarm := func(event string, active bool) {
+		if state.alarms[event] != active {
+			state.alarms[event] = active
+			changes = append(changes, plantAlarm{event, active})
+		}
+	}
+
+	day := reading.Time.Format("2006-01-02")
+	if state.day != day {
+		if state.day != "" && profile.MinLight != nil {
+			setAlarm("too_dark", state.maxLux < *profile.MinLight)
+		}
+		state.day = day
+		state.dli = 0
+		state.maxLux = 0
+	}
+	values := map[string]float64{}
+	for _, v := range reading.Values {
+		values[v.Service] = v.Value
+	}
+	if lux, ok := values["sensor_lumin"]; ok {
+		if gap := reading.Time.Sub(state.lastTime); !state.lastTime.IsZero() && gap > 0 && gap <= maxDliGap {
+			ppfd := (lux + state.lastLux) / 2 * luxToPpfd
+			state.dli += ppfd * gap.Seconds() / 1000000
+		}
+		state.lastLux = lux
+		state.lastTime = reading.Time
+		state.maxLux = math.Max(state.maxLux, lux)
+		reading.Add("sensor_dli", math.Round(state.dli*100)/100, dliUnit)
+	}
+
+	for _, limit := range profile.limits() {
+		v, ok := values[limit.service]
+		if !ok {
+			continue
+		}
+		h := profile.hysteresis(limit)
+		if limit.min != nil {
+			if v < *limit.min {
+				setAlarm(limit.lowEvent, true)
+			} else if v >= *limit.min+h {
+				setAlarm(limit.lowEvent, false)
+			}
+		}
+		if limit.max != nil {
+			if v > *limit.max {
+				setAlarm(limit.highEvent, true)
+			} else if v <= *limit.max-h {
+				setAlarm(limit.highEvent, false)
+			}
+		}
+	}
+	return changes
+}
+
+// ActiveAlarms returns sorted list of active alarms of the device.
+func (pc *PlantCare) ActiveAlarms(addr string) []string {
+	pc.lock.Lock()
+	defer pc.lock.Unlock()
+	var alarms []string
+	if state := pc.states[addr]; state != nil {
+		for event, active := range state.alarms {
+			if active {
+				alarms = append(alarms, event)
+			}
+		}
+	}
+	sort.Strings(alarms)
+	return alarms
+}
+
+// plantProfile returns profile of the plant the device is placed in.
+func (mg *MiFloraAd) plantProfile(addr string) (PlantProfile, bool) {
+	plant := mg.getDeviceConfig(addr).Plant
+	if plant == "" {
+		return PlantProfile{}, false
+	}
+	return mg.plantCare.Profile(plant)
+}
+
+// applyPlantCare adds daily light integral to the reading and publishes plant alarms.
+func (mg *MiFloraAd) applyPlantCare(reading *DeviceReading) {
+	profile, ok := mg.plantProfile(reading.Address)
+	if !ok {
+		return
+	}
+	for _, alarm := range mg.plantCare.Update(reading, profile) {
+		mg.reportPlantAlarm(reading.Address, alarm)
+	}
+}
+
+func (mg *MiFloraAd) reportPlantAlarm(addr string, alarm plantAlarm) {
+	status := "deactiv"
+	if alarm.active {
+		status = "activ"
+	}
+	log.Infof("<Ad> Plant alarm %s of %s is %s", alarm.event, addr, status)
+	service := "alarm_plant"
+	fimpAddr := deviceEventAddress(service, addr)
+	msg := fimpgo.NewStrMapMessage("evt.alarm.report", service, map[string]string{"event": alarm.event, "status": status}, nil, nil, nil)
+	mg.publishEvent(fimpAddr, msg)
+}
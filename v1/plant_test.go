@@ -0,0 +1,82 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPlantCareDailyLightIntegral(t *testing.T) {
+	day := time.Date(2018, 6, 1, 0, 0, 0, 0, time.Local)
+	profile := PlantProfile{Name: "ficus", MinLight: floatPtr(15000)}
+	cases := []struct {
+		name   string
+		at     time.Time
+		lux    float64
+		dli    float64
+		alarms []plantAlarm
+	}{
+		{"first reading", day.Add(8 * time.Hour), 20000, 0, nil},
+		// 20000 lux * 0.0185 * 3600 s
+		{"constant light", day.Add(9 * time.Hour), 20000, 1.33, nil},
+		// average of both readings is integrated
+		{"dimming", day.Add(9*time.Hour + 30*time.Minute), 10000, 1.83, nil},
+		{"gap over an hour", day.Add(11 * time.Hour), 10000, 1.83, nil},
+		{"dark", day.Add(11*time.Hour + 30*time.Minute), 0, 2, nil},
+		// the brightest reading of the previous day was above MinLight
+		{"next day", day.Add(32 * time.Hour), 5000, 0, nil},
+		{"next day light", day.Add(32*time.Hour + 30*time.Minute), 5000, 0.17, nil},
+		{"third day", day.Add(56 * time.Hour), 5000, 0, []plantAlarm{{"too_dark", true}}},
+	}
+	pc := NewPlantCare(nil)
+	for _, c := range cases {
+		reading := NewDeviceReading(testDeviceAddr, "miflora")
+		reading.Time = c.at
+		reading.Add("sensor_lumin", c.lux, "Lux")
+		alarms := pc.Update(reading, profile)
+		if !reflect.DeepEqual(alarms, c.alarms) {
+			t.Errorf("%s : expected alarms %v , got %v", c.name, c.alarms, alarms)
+		}
+		dli, ok := readingValue(reading, "sensor_dli")
+		if !ok || math.Abs(dli-c.dli) > 1e-9 {
+			t.Errorf("%s : expected DLI %v , got %v", c.name, c.dli, dli)
+		}
+	}
+}
+
+func TestPlantCareAlarmHysteresis(t *testing.T) {
+	profile := PlantProfile{Name: "ficus", MinMoisture: floatPtr(20), MaxMoisture: floatPtr(60)}
+	cases := []struct {
+		moisture float64
+		alarms   []plantAlarm
+	}{
+		{30, nil},
+		{19, []plantAlarm{{"needs_water", true}}},
+		// 5 % of the range has to be regained
+		{21, nil},
+		{22, []plantAlarm{{"needs_water", false}}},
+		{61, []plantAlarm{{"too_wet", true}}},
+		{59, nil},
+		{58, []plantAlarm{{"too_wet", false}}},
+	}
+	pc := NewPlantCare(nil)
+	start := time.Unix(1500000000, 0)
+	for i, c := range cases {
+		reading := NewDeviceReading(testDeviceAddr, "miflora")
+		reading.Time = start.Add(time.Duration(i) * time.Minute)
+		reading.Add("sensor_moist", c.moisture, "%")
+		if alarms := pc.Update(reading, profile); !reflect.DeepEqual(alarms, c.alarms) {
+			t.Errorf("moisture %v : expected alarms %v , got %v", c.moisture, c.alarms, alarms)
+		}
+	}
+}
+
+func readingValue(reading *DeviceReading, service string) (float64, bool) {
+	for _, v := range reading.Values {
+		if v.Service == service {
+			return v.Value, true
+		}
+	}
+	return 0, false
+}
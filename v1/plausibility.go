@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// PlausibilityRule describes which values of a service are accepted. Zero value of every check disables it.
+type PlausibilityRule struct {
+	Min          *float64
+	Max          *float64
+	MaxRate      float64 // max change per minute
+	MedianWindow int     // number of recent values used for spike rejection
+	MaxDeviation float64 // max distance from median of recent values
+}
+
+func floatPtr(v float64) *float64 {
+	return &v
+}
+
+// defaultPlausibilityRules are used for services which are not configured in Plausibility config section.
+var defaultPlausibilityRules = map[string]PlausibilityRule{
+	"sensor_temp":    {Min: floatPtr(-50), Max: floatPtr(100)},
+	"sensor_humid":   {Min: floatPtr(0), Max: floatPtr(100)},
+	"sensor_moist":   {Min: floatPtr(0), Max: floatPtr(100)},
+	"sensor_lumin":   {Min: floatPtr(0), Max: floatPtr(200000)},
+	"sensor_conduct": {Min: floatPtr(0), Max: floatPtr(20000)},
+	"battery":        {Min: floatPtr(0), Max: floatPtr(100)},
+}
+
+func (r PlausibilityRule) Validate() error {
+	if r.Min != nil && r.Max != nil && *r.Min > *r.Max {
+		return fmt.Errorf("Min %v is greater than Max %v", *r.Min, *r.Max)
+	}
+	if r.MaxRate < 0 || r.MaxDeviation < 0 || r.MedianWindow < 0 {
+		return fmt.Errorf("MaxRate , MedianWindow and MaxDeviation can't be negative")
+	}
+	if r.MedianWindow > 0 && r.MaxDeviation == 0 {
+		return fmt.Errorf("MedianWindow is set but MaxDeviation is 0")
+	}
+	return nil
+}
+
+type plausibilitySeries struct {
+	lastValue float64
+	lastTime  time.Time
+	window    []float64 // recent values which passed bounds check , including rejected spikes
+}
+
+// PlausibilityFilter drops values which are out of bounds , change too fast or deviate too much from recent values.
+type PlausibilityFilter struct {
+	rules  map[string]PlausibilityRule
+	lock   sync.Mutex
+	series map[string]*plausibilitySeries // addr|service -> state
+}
+
+func NewPlausibilityFilter(rules map[string]PlausibilityRule) *PlausibilityFilter {
+	merged := map[string]PlausibilityRule{}
+	for service, rule := range defaultPlausibilityRules {
+		merged[service] = rule
+	}
+	for service, rule := range rules {
+		merged[service] = rule
+	}
+	return &PlausibilityFilter{rules: merged, series: map[string]*plausibilitySeries{}}
+}
+
+// Check returns empty reason if value is accepted , otherwise short reason code and human readable description.
+func (f *PlausibilityFilter) Check(addr string, service string, value float64, t time.Time) (reason string, details string) {
+	rule, ok := f.rules[service]
+	if !ok {
+		return "", ""
+	}
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return "invalid", fmt.Sprintf("value %v is not a number", value)
+	}
+	if rule.Min != nil && value < *rule.Min {
+		return "below_min", fmt.Sprintf("value %v is below %v", value, *rule.Min)
+	}
+	if rule.Max != nil && value > *rule.Max {
+		return "above_max", fmt.Sprintf("value %v is above %v", value, *rule.Max)
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	key := addr + "|" + service
+	series := f.series[key]
+	if series == nil {
+		series = &plausibilitySeries{}
+		f.series[key] = series
+	}
+	if rule.MedianWindow > 0 {
+		series.window = append(series.window, value)
+		if len(series.window) > rule.MedianWindow {
+			series.window = series.window[len(series.window)-rule.MedianWindow:]
+		}
+		// median of less than 3 values can't tell which one is the spike
+		if len(series.window) >= 3 {
+			median := medianOf(series.window)
+			if math.Abs(value-median) > rule.MaxDeviation {
+				return "spike", fmt.Sprintf("value %v deviates from median %v by more than %v", value, median, rule.MaxDeviation)
+			}
+		}
+	}
+	if rule.MaxRate > 0 && !series.lastTime.IsZero() {
+		// time since last accepted value grows , so real step change is eventually accepted
+		minutes := math.Max(t.Sub(series.lastTime).Minutes(), 1.0/60)
+		if rate := math.Abs(value-series.lastValue) / minutes; rate > rule.MaxRate {
+			return "rate", fmt.Sprintf("value %v changed from %v at %.2f per minute , max is %v", value, series.lastValue, rate, rule.MaxRate)
+		}
+	}
+	series.lastValue = value
+	series.lastTime = t
+	return "", ""
+}
+
+func medianOf(values []float64) float64 {
+	sorted := append([]float64{}, values...)
+	sort.Float64s(sorted)
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+// filterReading removes implausible values from the reading. Every value is checked on it's own , so one bad value doesn't drop the others.
+func (mg *MiFloraAd) filterReading(reading *DeviceReading) {
+	var accepted []SensorValue
+	for _, v := range reading.Values {
+		if reason, details := mg.plausibility.Check(reading.Address, v.Service, v.Value, reading.Time); reason != "" {
+			mg.rejectValue(reading.Address, v.Service, reason, details)
+			continue
+		}
+		accepted = append(accepted, v)
+	}
+	reading.Values = accepted
+	if reading.HasBattery {
+		if reason, details := mg.plausibility.Check(reading.Address, "battery", float64(reading.Battery), reading.Time); reason != "" {
+			mg.rejectValue(reading.Address, "battery", reason, details)
+			reading.HasBattery = false
+		}
+	}
+}
+
+func (mg *MiFloraAd) rejectValue(addr string, service string, reason string, details string) {
+	log.Warnf("<Ad> Rejected %s of %s : %s", service, addr, details)
+	metricRejectedValues.WithLabelValues(service, reason).Inc()
+	mg.lock.Lock()
+	if state := mg.deviceStates[addr]; state != nil {
+		state.RejectedValues++
+	}
+	mg.lock.Unlock()
+}
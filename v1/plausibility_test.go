@@ -0,0 +1,74 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestPlausibilityFilter(t *testing.T) {
+	type sample struct {
+		at     time.Duration // since the first value
+		value  float64
+		reason string
+	}
+	cases := []struct {
+		name    string
+		rule    PlausibilityRule
+		samples []sample
+	}{
+		{"range", PlausibilityRule{Min: floatPtr(0), Max: floatPtr(100)}, []sample{
+			{0, 0, ""}, {time.Minute, 100, ""}, {2 * time.Minute, -0.1, "below_min"}, {3 * time.Minute, 100.5, "above_max"},
+			{4 * time.Minute, math.NaN(), "invalid"}, {5 * time.Minute, math.Inf(1), "invalid"},
+		}},
+		{"rate", PlausibilityRule{MaxRate: 2}, []sample{
+			{0, 20, ""}, {time.Minute, 22, ""}, {2 * time.Minute, 30, "rate"},
+			// rate is counted from the last accepted value , so the step is accepted later
+			{5 * time.Minute, 30, ""}, {5*time.Minute + time.Second, 30.1, "rate"},
+		}},
+		{"spike", PlausibilityRule{MedianWindow: 3, MaxDeviation: 5}, []sample{
+			// median of less than 3 values doesn't reject anything
+			{0, 20, ""}, {time.Minute, 50, ""}, {2 * time.Minute, 21, ""},
+			{3 * time.Minute, 60, "spike"}, {4 * time.Minute, 22, ""},
+			// level change is accepted once it's the majority of the window
+			{5 * time.Minute, 23, ""}, {6 * time.Minute, 40, "spike"}, {7 * time.Minute, 40, ""},
+		}},
+	}
+	start := time.Unix(1500000000, 0)
+	for _, c := range cases {
+		f := NewPlausibilityFilter(map[string]PlausibilityRule{"sensor_test": c.rule})
+		for i, s := range c.samples {
+			if reason, details := f.Check(testDeviceAddr, "sensor_test", s.value, start.Add(s.at)); reason != s.reason {
+				t.Errorf("%s , value %d (%v) : expected %q , got %q %s", c.name, i, s.value, s.reason, reason, details)
+			}
+		}
+	}
+
+	f := NewPlausibilityFilter(nil)
+	if reason, _ := f.Check(testDeviceAddr, "sensor_temp", -60, start); reason != "below_min" {
+		t.Errorf("default range of sensor_temp wasn't applied , got %q", reason)
+	}
+	if reason, _ := f.Check(testDeviceAddr, "sensor_unknown", -1e9, start); reason != "" {
+		t.Errorf("value of service without rule was rejected : %q", reason)
+	}
+}
+
+func TestPlausibilityRuleValidate(t *testing.T) {
+	cases := []struct {
+		name  string
+		rule  PlausibilityRule
+		valid bool
+	}{
+		{"empty", PlausibilityRule{}, true},
+		{"range", PlausibilityRule{Min: floatPtr(0), Max: floatPtr(100)}, true},
+		{"inverted range", PlausibilityRule{Min: floatPtr(10), Max: floatPtr(0)}, false},
+		{"negative rate", PlausibilityRule{MaxRate: -1}, false},
+		{"window without deviation", PlausibilityRule{MedianWindow: 5}, false},
+		{"spike", PlausibilityRule{MedianWindow: 5, MaxDeviation: 3}, true},
+	}
+	for _, c := range cases {
+		if err := c.rule.Validate(); (err == nil) != c.valid {
+			t.Errorf("%s : expected valid %v , got %v", c.name, c.valid, err)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"path/filepath"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// SensorValue is a single measurement , reported over FIMP as sensor service.
+type SensorValue struct {
+	Service    string
+	Value      float64
+	Unit       string
+	Raw        float64 // value before calibration
+	Calibrated bool
+}
+
+// DeviceReading is the result of one read of a device. FIMP reports and all other outputs are generated from it.
+type DeviceReading struct {
+	Address    string
+	Alias      string
+	Type       string // device type , for instance miflora
+	Values     []SensorValue
+	Battery    int
+	HasBattery bool
+	Rssi       int
+	HasRssi    bool
+	Firmware   string // firmware version , if the driver reads it together with values
+	Time       time.Time
+}
+
+func NewDeviceReading(addr string, devType string) *DeviceReading {
+	return &DeviceReading{Address: addr, Type: devType, Time: time.Now()}
+}
+
+func (r *DeviceReading) Add(service string, value float64, unit string) {
+	r.Values = append(r.Values, SensorValue{Service: service, Value: value, Unit: unit})
+}
+
+func (r *DeviceReading) SetBattery(level int) {
+	r.Battery = level
+	r.HasBattery = true
+}
+
+func (r *DeviceReading) SetRssi(rssi int) {
+	r.Rssi = rssi
+	r.HasRssi = true
+}
+
+// Copy returns deep copy of the reading.
+func (r *DeviceReading) Copy() *DeviceReading {
+	c := *r
+	c.Values = append([]SensorValue{}, r.Values...)
+	return &c
+}
+
+// IsEmpty returns true if nothing was read from the device.
+func (r *DeviceReading) IsEmpty() bool {
+	return len(r.Values) == 0 && !r.HasBattery
+}
+
+// ReadingSink is an output which receives every device reading , for instance Home Assistant publisher.
+type ReadingSink interface {
+	Name() string
+	PublishReading(reading *DeviceReading)
+}
+
+// ReachabilitySink is implemented by outputs which track whether device is reachable.
+type ReachabilitySink interface {
+	DeviceUnreachable(addr string)
+}
+
+func (mg *MiFloraAd) initSinks() {
+	if mg.config.HomeAssistant.Enabled {
+		mg.sinks = append(mg.sinks, NewHomeAssistantSink(mg.config.HomeAssistant, mg.msgTransport, mg.deviceMeta))
+	}
+	if mg.config.Homie.Enabled {
+		mg.sinks = append(mg.sinks, NewHomieSink(mg.config.Homie, mg.msgTransport, mg.deviceMeta))
+	}
+	if mg.config.MetricsListenAddress != "" {
+		mg.sinks = append(mg.sinks, &MetricsSink{})
+	}
+	if mg.config.History.Enabled {
+		if mg.config.History.File == "" {
+			mg.config.History.File = filepath.Join(filepath.Dir(mg.configPath), "history.db")
+		}
+		history, err := NewHistoryStore(mg.config.History)
+		if err != nil {
+			log.Error("<Ad> Can't open history store : ", err)
+		} else {
+			mg.history = history
+			mg.sinks = append(mg.sinks, history)
+		}
+	}
+	if mg.config.Influx.Enabled {
+		mg.sinks = append(mg.sinks, NewInfluxSink(mg.config.Influx))
+	}
+	if mg.config.MqttJsonTopic != "" {
+		mg.sinks = append(mg.sinks, NewJsonSink(mg.config.MqttJsonTopic, mg.config.MqttJsonRetain, mg.config.MqttJsonQos, mg.msgTransport))
+	}
+}
+
+// publishReading sends reading as FIMP events and to all enabled outputs.
+func (mg *MiFloraAd) publishReading(reading *DeviceReading) {
+	if reading.IsEmpty() {
+		return
+	}
+	reading.Alias = mg.getDeviceConfig(reading.Address).Alias
+	mg.calibrate(reading)
+	mg.filterReading(reading)
+	if reading.IsEmpty() {
+		return
+	}
+	mg.trackBattery(reading)
+	mg.addDerivedMetrics(reading)
+	mg.applyPlantCare(reading)
+	mg.storeLastReading(reading)
+	if !mg.config.DisableFimpReports {
+		// report policies apply only to FIMP reports , other outputs get every value
+		force := mg.takeForcedReport(reading.Address)
+		if reading.HasBattery && mg.reportFilter.ShouldReport(reading.Address, "battery", float64(reading.Battery), reading.Time, force) {
+			mg.reportBatteryLevel(reading.Address, byte(reading.Battery))
+		}
+		for _, v := range mg.fimpValues(reading) {
+			if mg.reportFilter.ShouldReport(reading.Address, v.Service, v.Value, reading.Time, force) {
+				mg.reportSensor(reading.Address, v)
+			}
+		}
+	}
+	for _, sink := range mg.sinks {
+		sink.PublishReading(reading)
+	}
+}
+
+// reportUnreachable notifies outputs that nothing could be read from the device.
+func (mg *MiFloraAd) reportUnreachable(addr string) {
+	for _, sink := range mg.sinks {
+		if rs, ok := sink.(ReachabilitySink); ok {
+			rs.DeviceUnreachable(addr)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// ReportPolicy limits how often unchanged values are reported to the hub. Zero policy reports every value ,
+// policy with heartbeat only reports every change.
+type ReportPolicy struct {
+	Deadband        float64 // min absolute change which is reported
+	DeadbandPercent float64 // min change in percent of last reported value
+	Heartbeat       int     // value is reported at least every N minutes even if it didn't change , 0 disables heartbeat
+}
+
+// defaultReportPolicy is the key of the policy used for services without own policy.
+const defaultReportPolicy = "default"
+
+func (p ReportPolicy) isZero() bool {
+	return p.Deadband == 0 && p.DeadbandPercent == 0 && p.Heartbeat == 0
+}
+
+type reportedValue struct {
+	value float64
+	time  time.Time
+}
+
+// ReportFilter decides which FIMP sensor reports are published , based on last reported value of every device service.
+type ReportFilter struct {
+	policies map[string]ReportPolicy
+	lock     sync.Mutex
+	last     map[string]reportedValue // addr|service -> last reported value
+}
+
+func NewReportFilter(policies map[string]ReportPolicy) *ReportFilter {
+	return &ReportFilter{policies: policies, last: map[string]reportedValue{}}
+}
+
+func (f *ReportFilter) policy(service string) ReportPolicy {
+	if p, ok := f.policies[service]; ok {
+		return p
+	}
+	return f.policies[defaultReportPolicy]
+}
+
+// ShouldReport returns true if value has to be reported and remembers it as last reported value. Forced value is always reported.
+func (f *ReportFilter) ShouldReport(addr string, service string, value float64, t time.Time, force bool) bool {
+	p := f.policy(service)
+	key := addr + "|" + service
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	last, ok := f.last[key]
+	report := force || !ok || p.isZero()
+	if !report && p.Heartbeat > 0 && t.Sub(last.time) >= time.Duration(p.Heartbeat)*time.Minute {
+		report = true
+	}
+	if !report {
+		change := math.Abs(value - last.value)
+		if p.Deadband == 0 && p.DeadbandPercent == 0 && change > 0 {
+			report = true
+		}
+		if p.Deadband > 0 && change >= p.Deadband {
+			report = true
+		}
+		if p.DeadbandPercent > 0 && last.value != 0 && change*100/math.Abs(last.value) >= p.DeadbandPercent {
+			report = true
+		}
+		if p.DeadbandPercent > 0 && last.value == 0 && change > 0 {
+			report = true
+		}
+	}
+	if report {
+		f.last[key] = reportedValue{value: value, time: t}
+	}
+	return report
+}
+
+// requestReport reads the device and reports all values regardless of report policies. It's used for explicit requests from the hub.
+func (mg *MiFloraAd) requestReport(addr string) {
+	mg.lock.Lock()
+	mg.forcedReports[addr] = true
+	mg.lock.Unlock()
+	mg.enqueueSensorRequest(addr)
+}
+
+// takeForcedReport returns true once after report of the device was requested explicitly.
+func (mg *MiFloraAd) takeForcedReport(addr string) bool {
+	mg.lock.Lock()
+	defer mg.lock.Unlock()
+	force := mg.forcedReports[addr]
+	delete(mg.forcedReports, addr)
+	return force
+}
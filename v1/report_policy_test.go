@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReportFilter(t *testing.T) {
+	type sample struct {
+		at     time.Duration // since the first value
+		value  float64
+		force  bool
+		report bool
+	}
+	cases := []struct {
+		name    string
+		policy  ReportPolicy
+		samples []sample
+	}{
+		{"zero policy", ReportPolicy{}, []sample{
+			{0, 20, false, true}, {time.Minute, 20, false, true}, {2 * time.Minute, 20.1, false, true},
+		}},
+		{"changes only", ReportPolicy{Heartbeat: 60}, []sample{
+			{0, 20, false, true}, {time.Minute, 20, false, false}, {2 * time.Minute, 20.1, false, true},
+			{3 * time.Minute, 20.1, false, false},
+		}},
+		{"deadband", ReportPolicy{Deadband: 0.5}, []sample{
+			{0, 20, false, true}, {time.Minute, 20.4, false, false},
+			// change is counted from the last reported value , not from the last value
+			{2 * time.Minute, 20.5, false, true}, {3 * time.Minute, 20.1, false, false}, {4 * time.Minute, 19.9, false, true},
+		}},
+		{"deadband percent", ReportPolicy{DeadbandPercent: 10}, []sample{
+			{0, 50, false, true}, {time.Minute, 54, false, false}, {2 * time.Minute, 45, false, true},
+			{3 * time.Minute, 0, false, true}, {4 * time.Minute, 0, false, false}, {5 * time.Minute, 0.1, false, true},
+		}},
+		{"heartbeat", ReportPolicy{Deadband: 5, Heartbeat: 30}, []sample{
+			{0, 20, false, true}, {29 * time.Minute, 21, false, false}, {30 * time.Minute, 21, false, true},
+			{40 * time.Minute, 21, false, false}, {60 * time.Minute, 21, false, true},
+		}},
+		{"forced", ReportPolicy{Deadband: 5, Heartbeat: 30}, []sample{
+			{0, 20, false, true}, {time.Minute, 20, true, true}, {2 * time.Minute, 21, false, false},
+		}},
+	}
+	start := time.Unix(1500000000, 0)
+	for _, c := range cases {
+		f := NewReportFilter(map[string]ReportPolicy{"sensor_temp": c.policy})
+		for i, s := range c.samples {
+			if report := f.ShouldReport(testDeviceAddr, "sensor_temp", s.value, start.Add(s.at), s.force); report != s.report {
+				t.Errorf("%s , value %d (%v) : expected report %v , got %v", c.name, i, s.value, s.report, report)
+			}
+		}
+	}
+}
+
+func TestReportFilterDefaultPolicy(t *testing.T) {
+	f := NewReportFilter(map[string]ReportPolicy{defaultReportPolicy: {Deadband: 1}, "sensor_lumin": {}})
+	start := time.Unix(1500000000, 0)
+	for _, service := range []string{"sensor_temp", "sensor_lumin"} {
+		f.ShouldReport(testDeviceAddr, service, 20, start, false)
+	}
+	if f.ShouldReport(testDeviceAddr, "sensor_temp", 20.5, start.Add(time.Minute), false) {
+		t.Error("default policy wasn't applied to service without own policy")
+	}
+	if !f.ShouldReport(testDeviceAddr, "sensor_lumin", 20.5, start.Add(time.Minute), false) {
+		t.Error("own policy of the service wasn't applied")
+	}
+	// series of devices are independent
+	if !f.ShouldReport("C4:7C:8D:6A:3E:8C", "sensor_temp", 20.5, start.Add(time.Minute), false) {
+		t.Error("first value of other device wasn't reported")
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+// Service migration modes. Older versions published Mi Flora soil moisture as sensor_humid , which hub treats as air humidity.
+const (
+	ServiceModeNew    = "new"    // only current services
+	ServiceModeBoth   = "both"   // current and legacy services , default during transition
+	ServiceModeLegacy = "legacy" // only legacy services , same as old versions
+)
+
+// legacyServices maps driver name to current service names and the names used by older versions of the driver.
+// Only copies published under legacy name are affected by migration mode , services the driver declares itself are always announced.
+var legacyServices = map[string]map[string]string{
+	"miflora": {"sensor_moist": "sensor_humid"},
+}
+
+// legacyServicesOf returns legacy service names of the device driver.
+func (mg *MiFloraAd) legacyServicesOf(addr string) map[string]string {
+	return legacyServices[mg.driverForDevice(addr).Name()]
+}
+
+func isValidServiceMode(mode string) bool {
+	switch mode {
+	case "", ServiceModeNew, ServiceModeBoth, ServiceModeLegacy:
+		return true
+	}
+	return false
+}
+
+func (mg *MiFloraAd) serviceMode() string {
+	if mg.config.ServiceMode == "" {
+		return ServiceModeBoth
+	}
+	return mg.config.ServiceMode
+}
+
+// fimpValues returns values which should be published as FIMP sensor reports according to service migration mode.
+func (mg *MiFloraAd) fimpValues(reading *DeviceReading) []SensorValue {
+	aliases := mg.legacyServicesOf(reading.Address)
+	var values []SensorValue
+	for _, v := range reading.Values {
+		legacy, ok := aliases[v.Service]
+		if !ok {
+			values = append(values, v)
+			continue
+		}
+		if mg.announceCurrent() {
+			values = append(values, v)
+		}
+		if mg.announceLegacy() {
+			lv := v
+			lv.Service = legacy
+			values = append(values, lv)
+		}
+	}
+	return values
+}
+
+// announceCurrent returns false if services which have legacy name are published only under legacy name.
+func (mg *MiFloraAd) announceCurrent() bool {
+	return mg.serviceMode() != ServiceModeLegacy
+}
+
+// announceLegacy returns true if services which have legacy name are published also under legacy name.
+func (mg *MiFloraAd) announceLegacy() bool {
+	return mg.serviceMode() != ServiceModeNew
+}
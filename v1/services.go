@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/alivinco/fimpgo"
+	"github.com/alivinco/fimpgo/fimptype"
+)
+
+// InterfaceDescriptor is a FIMP message the service accepts (in) or sends (out).
+type InterfaceDescriptor struct {
+	Type      string // in or out
+	MsgType   string
+	ValueType string
+}
+
+// ServiceDescriptor declares FIMP service of a device. Inclusion reports , node list and report validation are generated from it.
+type ServiceDescriptor struct {
+	Name       string
+	Units      []string
+	Props      map[string]interface{}
+	Interfaces []InterfaceDescriptor
+}
+
+func (s ServiceDescriptor) Interface(ifType string, msgType string) (InterfaceDescriptor, bool) {
+	for _, i := range s.Interfaces {
+		if i.Type == ifType && i.MsgType == msgType {
+			return i, true
+		}
+	}
+	return InterfaceDescriptor{}, false
+}
+
+func sensorService(name string, unit string) ServiceDescriptor {
+	return ServiceDescriptor{
+		Name:  name,
+		Units: []string{unit},
+		Interfaces: []InterfaceDescriptor{
+			{"out", "evt.sensor.report", fimpgo.VTypeFloat},
+			{"in", "cmd.sensor.get_report", fimpgo.VTypeString},
+			{"in", "cmd.sensor.set_calibration", fimpgo.VTypeObject},
+			{"in", "cmd.sensor.get_calibration", fimpgo.VTypeNull},
+			{"out", "evt.sensor.calibration_report", fimpgo.VTypeObject},
+		},
+	}
+}
+
+// derivedSensorService is a calculated value , it can't be requested or calibrated on it's own.
+func derivedSensorService(name string, unit string) ServiceDescriptor {
+	return ServiceDescriptor{
+		Name:       name,
+		Units:      []string{unit},
+		Interfaces: []InterfaceDescriptor{{"out", "evt.sensor.report", fimpgo.VTypeFloat}},
+	}
+}
+
+func batteryService() ServiceDescriptor {
+	return ServiceDescriptor{
+		Name: "battery",
+		Interfaces: []InterfaceDescriptor{
+			{"out", "evt.lvl.report", fimpgo.VTypeInt},
+			{"in", "cmd.lvl.get_report", fimpgo.VTypeNull},
+			{"out", "evt.alarm.report", fimpgo.VTypeStrMap},
+			{"in", "cmd.battery.get_estimate", fimpgo.VTypeNull},
+			{"out", "evt.battery.estimate_report", fimpgo.VTypeObject},
+		},
+	}
+}
+
+func plantAlarmService() ServiceDescriptor {
+	return ServiceDescriptor{
+		Name:       "alarm_plant",
+		Props:      map[string]interface{}{"sup_events": []string{"needs_water", "too_wet", "needs_fertilizer", "too_much_fertilizer", "too_cold", "too_hot", "too_dark", "too_bright"}},
+		Interfaces: []InterfaceDescriptor{{"out", "evt.alarm.report", fimpgo.VTypeStrMap}},
+	}
+}
+
+func gattPassthroughService() ServiceDescriptor {
+	return ServiceDescriptor{
+		Name: gattService,
+		Interfaces: []InterfaceDescriptor{
+			{"in", "cmd.gatt.get_services", fimpgo.VTypeNull},
+			{"out", "evt.gatt.services_report", fimpgo.VTypeObject},
+			{"in", "cmd.gatt.read", fimpgo.VTypeStrMap},
+			{"out", "evt.gatt.read_report", fimpgo.VTypeStrMap},
+			{"in", "cmd.gatt.write", fimpgo.VTypeStrMap},
+			{"out", "evt.gatt.write_report", fimpgo.VTypeStrMap},
+			{"in", "cmd.gatt.subscribe", fimpgo.VTypeStrMap},
+			{"in", "cmd.gatt.unsubscribe", fimpgo.VTypeStrMap},
+			{"out", "evt.gatt.notify_report", fimpgo.VTypeStrMap},
+		},
+	}
+}
+
+// validateServiceDescriptors checks services declared by drivers and that every declared command has a handler.
+func validateServiceDescriptors() []string {
+	var problems []string
+	var names []string
+	for name := range drivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		seen := map[string]bool{}
+		for _, s := range drivers[name].Services() {
+			if seen[s.Name] {
+				problems = append(problems, fmt.Sprintf("driver %s declares service %s twice", name, s.Name))
+			}
+			seen[s.Name] = true
+			if len(s.Interfaces) == 0 {
+				problems = append(problems, fmt.Sprintf("driver %s declares service %s without interfaces", name, s.Name))
+			}
+			for _, i := range s.Interfaces {
+				if i.Type != "in" && i.Type != "out" {
+					problems = append(problems, fmt.Sprintf("driver %s , service %s : interface %s has invalid type %s", name, s.Name, i.MsgType, i.Type))
+				}
+			}
+		}
+		problems = append(problems, validateCommandHandlers("driver "+name, drivers[name].Services())...)
+	}
+	problems = append(problems, validateCommandHandlers("adapter", adapterServiceDescriptors())...)
+	return problems
+}
+
+// deviceServices returns all services of the device , the ones of the driver and the ones added by the adapter.
+func (mg *MiFloraAd) deviceServices(addr string) []ServiceDescriptor {
+	driverServices := mg.driverForDevice(addr).Services()
+	var services []ServiceDescriptor
+	has := map[string]bool{}
+	aliases := mg.legacyServicesOf(addr)
+	for _, s := range driverServices {
+		has[s.Name] = true
+		legacy, migrated := aliases[s.Name]
+		if !migrated || mg.announceCurrent() {
+			services = append(services, s)
+		}
+		if migrated && mg.announceLegacy() {
+			ls := s
+			ls.Name = legacy
+			services = append(services, ls)
+		}
+	}
+	if has["sensor_temp"] && has["sensor_humid"] {
+		for _, name := range mg.config.DerivedMetrics {
+			if m, ok := derivedMetrics[name]; ok {
+				services = append(services, derivedSensorService(m.Service, m.Unit))
+			}
+		}
+	}
+	if _, ok := mg.plantProfile(addr); ok {
+		services = append(services, derivedSensorService("sensor_dli", dliUnit), plantAlarmService())
+	}
+	services = append(services, gattPassthroughService())
+	for i := range services {
+		for _, intf := range services[i].Interfaces {
+			if intf.Type == "in" {
+				// copy , so the slice of driver descriptor isn't modified
+				services[i].Interfaces = append(append([]InterfaceDescriptor{}, services[i].Interfaces...), errorReportInterface)
+				break
+			}
+		}
+	}
+	return services
+}
+
+func (mg *MiFloraAd) findDeviceService(addr string, name string) (ServiceDescriptor, bool) {
+	for _, s := range mg.deviceServices(addr) {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return ServiceDescriptor{}, false
+}
+
+// inclusionServices converts service descriptors of the device to inclusion report services.
+func (mg *MiFloraAd) inclusionServices(addr string) []fimptype.Service {
+	fimpAddr := macToFimpMac(addr)
+	var services []fimptype.Service
+	for _, s := range mg.deviceServices(addr) {
+		props := map[string]interface{}{}
+		for k, v := range s.Props {
+			props[k] = v
+		}
+		if len(s.Units) > 0 {
+			props["sup_units"] = s.Units
+		}
+		service := fimptype.Service{
+			Name:       s.Name,
+			Alias:      "",
+			Enabled:    true,
+			Address:    "/rt:dev/rn:ble/ad:1/sv:" + s.Name + "/ad:" + fimpAddr,
+			Groups:     []string{"ch_0"},
+			Props:      props,
+			Tags:       []string{},
+			Interfaces: []fimptype.Interface{},
+		}
+		for _, i := range s.Interfaces {
+			service.Interfaces = append(service.Interfaces, fimptype.Interface{Type: i.Type, MsgType: i.MsgType, ValueType: i.ValueType, Version: "1"})
+		}
+		services = append(services, service)
+	}
+	return services
+}
+
+// checkDeclaredEvent verifies that device event matches service declared in inclusion report. Mismatch is logged , event is still sent.
+func (mg *MiFloraAd) checkDeclaredEvent(addr *fimpgo.Address, msg *fimpgo.FimpMessage) bool {
+	if addr.ResourceType != fimpgo.ResourceTypeDevice {
+		return true
+	}
+	var problem string
+	if service, ok := mg.findDeviceService(normalizeMac(addr.ServiceAddress), addr.ServiceName); !ok {
+		problem = "service is not declared"
+	} else if intf, ok := service.Interface("out", msg.Type); !ok {
+		problem = "message type is not declared"
+	} else if intf.ValueType != msg.ValueType && msg.ValueType != fimpgo.VTypeNull {
+		// null is a valid answer when there is nothing to report
+		problem = fmt.Sprintf("value type %s doesn't match declared %s", msg.ValueType, intf.ValueType)
+	}
+	if problem == "" {
+		return true
+	}
+	log.Errorf("<Ad> Event %s of %s/%s doesn't match inclusion report : %s", msg.Type, addr.ServiceAddress, addr.ServiceName, problem)
+	metricUndeclaredEvents.Inc()
+	return false
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alivinco/fimpgo"
+)
+
+const testDeviceAddr = "C4:7C:8D:6A:3E:8B"
+
+type capturedEvent struct {
+	addr *fimpgo.Address
+	msg  *fimpgo.FimpMessage
+}
+
+// captureTransport keeps published FIMP messages instead of sending them to broker.
+type captureTransport struct {
+	lock     sync.Mutex
+	events   []capturedEvent
+	retained map[string][]byte // last payload of every topic published with retain flag
+}
+
+func (t *captureTransport) Publish(addr *fimpgo.Address, fimpMsg *fimpgo.FimpMessage) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.events = append(t.events, capturedEvent{addr, fimpMsg})
+	return nil
+}
+
+func (t *captureTransport) PublishRaw(topic string, payload []byte, qos byte, retain bool) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if retain {
+		if t.retained == nil {
+			t.retained = map[string][]byte{}
+		}
+		t.retained[topic] = payload
+	}
+	return nil
+}
+
+func (t *captureTransport) IsConnected() bool {
+	return true
+}
+
+func (t *captureTransport) IsTls() bool {
+	return false
+}
+
+func (t *captureTransport) AddGlobalPrefix(topic string) string {
+	return topic
+}
+
+// take returns messages published since previous call.
+func (t *captureTransport) take() []capturedEvent {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	events := t.events
+	t.events = nil
+	return events
+}
+
+func newTestAdapter(t *testing.T, config MifloraConfig, plants map[string]PlantProfile) (*MiFloraAd, *captureTransport) {
+	dir, err := ioutil.TempDir("", "ble-ad")
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport := &captureTransport{}
+	mg := &MiFloraAd{configPath: filepath.Join(dir, "config.json"), config: config, msgTransport: transport}
+	mg.deviceStates = map[string]*DeviceState{}
+	mg.forcedReports = map[string]bool{}
+	mg.batteryRequests = map[string][]*fimpgo.FimpMessage{}
+	mg.streams = map[string]chan struct{}{}
+	mg.offlineQueue = NewOfflineQueue(filepath.Join(dir, "offline_queue.jsonl"), 0, 0)
+	mg.plausibility = NewPlausibilityFilter(config.Plausibility)
+	mg.reportFilter = NewReportFilter(config.ReportPolicies)
+	mg.plantCare = NewPlantCare(plants)
+	mg.batteries = NewBatteryTracker("", config.BatteryAlarmThresholds)
+	mg.deviceInfo = NewDeviceInfoCache(filepath.Join(dir, "device_info.json"))
+	return mg, transport
+}
+
+// assertDeclared checks that every device event is declared by service of the device , the same way inclusion report declares it.
+func assertDeclared(t *testing.T, mg *MiFloraAd, events []capturedEvent) {
+	for _, ev := range events {
+		if ev.addr.ResourceType != fimpgo.ResourceTypeDevice {
+			continue
+		}
+		addr := normalizeMac(ev.addr.ServiceAddress)
+		service, ok := mg.findDeviceService(addr, ev.addr.ServiceName)
+		if !ok {
+			t.Errorf("%s of %s : service %s is not declared", ev.msg.Type, addr, ev.addr.ServiceName)
+			continue
+		}
+		if ev.msg.Service != service.Name {
+			t.Errorf("%s : message service %s doesn't match address service %s", ev.msg.Type, ev.msg.Service, service.Name)
+		}
+		intf, ok := service.Interface("out", ev.msg.Type)
+		if !ok {
+			t.Errorf("%s/%s : message type %s is not declared", addr, service.Name, ev.msg.Type)
+			continue
+		}
+		if intf.ValueType != ev.msg.ValueType && ev.msg.ValueType != fimpgo.VTypeNull {
+			t.Errorf("%s/%s %s : value type %s doesn't match declared %s", addr, service.Name, ev.msg.Type, ev.msg.ValueType, intf.ValueType)
+		}
+		if unit, ok := ev.msg.Properties["unit"]; ok && !hasUnit(service, unit) {
+			t.Errorf("%s/%s %s : unit %s isn't in declared units %v", addr, service.Name, ev.msg.Type, unit, service.Units)
+		}
+	}
+}
+
+func hasUnit(service ServiceDescriptor, unit string) bool {
+	for _, u := range service.Units {
+		if u == unit {
+			return true
+		}
+	}
+	return false
+}
+
+// assertPublished checks that events contain all expected "service msg_type" pairs , so assertDeclared doesn't pass on nothing.
+func assertPublished(t *testing.T, events []capturedEvent, expected ...string) {
+	published := map[string]bool{}
+	for _, ev := range events {
+		published[ev.addr.ServiceName+" "+ev.msg.Type] = true
+	}
+	for _, e := range expected {
+		if !published[e] {
+			t.Errorf("%s wasn't published", e)
+		}
+	}
+}
+
+func assertNotPublished(t *testing.T, events []capturedEvent, service string, msgType string) {
+	for _, ev := range events {
+		if ev.addr.ServiceName == service && ev.msg.Type == msgType {
+			t.Errorf("%s %s was published with value %v", service, msgType, ev.msg.Value)
+		}
+	}
+}
+
+var serviceModes = []string{ServiceModeNew, ServiceModeBoth, ServiceModeLegacy}
+
+func TestMifloraEventsMatchServices(t *testing.T) {
+	for _, mode := range serviceModes {
+		t.Run(mode, func(t *testing.T) {
+			testMifloraEvents(t, mode)
+		})
+	}
+}
+
+// moistureServices returns services Mi Flora soil moisture is published as in the migration mode , and the ones it mustn't be published as.
+func moistureServices(mode string) (published []string, hidden []string) {
+	switch mode {
+	case ServiceModeNew:
+		return []string{"sensor_moist"}, []string{"sensor_humid"}
+	case ServiceModeLegacy:
+		return []string{"sensor_humid"}, []string{"sensor_moist"}
+	}
+	return []string{"sensor_moist", "sensor_humid"}, nil
+}
+
+func testMifloraEvents(t *testing.T, mode string) {
+	config := MifloraConfig{
+		ServiceMode:      mode,
+		DeviceAddresses:  []string{testDeviceAddr},
+		Devices:          []DeviceConfig{{Address: testDeviceAddr, Plant: "ficus", Calibration: map[string]Calibration{"sensor_temp": {Offset: -0.5}}}},
+		PublishRawValues: true,
+	}
+	plants := map[string]PlantProfile{"ficus": {Name: "ficus", MinMoisture: floatPtr(30), MaxTemp: floatPtr(30)}}
+	mg, transport := newTestAdapter(t, config, plants)
+	defer os.RemoveAll(filepath.Dir(mg.configPath))
+
+	reading := NewDeviceReading(testDeviceAddr, "miflora")
+	reading.Add("sensor_temp", 21.5, "C")
+	reading.Add("sensor_lumin", 1200, "Lux")
+	reading.Add("sensor_moist", 15, "%")
+	reading.Add("sensor_conduct", 350, "µS/cm")
+	reading.SetBattery(8)
+	mg.publishReading(reading)
+	events := transport.take()
+	moisture, hidden := moistureServices(mode)
+	assertDeclared(t, mg, events)
+	for _, service := range moisture {
+		assertPublished(t, events, service+" evt.sensor.report")
+	}
+	for _, service := range hidden {
+		assertNotPublished(t, events, service, "evt.sensor.report")
+	}
+	assertPublished(t, events,
+		"sensor_temp evt.sensor.report",
+		"sensor_lumin evt.sensor.report",
+		"sensor_conduct evt.sensor.report",
+		"sensor_dli evt.sensor.report",
+		"alarm_plant evt.alarm.report",
+		"battery evt.lvl.report",
+		"battery evt.alarm.report",
+		"battery evt.battery.estimate_report",
+	)
+
+	// implausible temperature is dropped , the other values are still reported
+	reading = NewDeviceReading(testDeviceAddr, "miflora")
+	reading.Time = reading.Time.Add(10 * time.Minute)
+	reading.Add("sensor_temp", 150, "C")
+	reading.Add("sensor_lumin", 1500, "Lux")
+	reading.Add("sensor_moist", 40, "%")
+	mg.publishReading(reading)
+	events = transport.take()
+	assertDeclared(t, mg, events)
+	assertPublished(t, events, "sensor_lumin evt.sensor.report", moisture[0]+" evt.sensor.report", "alarm_plant evt.alarm.report")
+	assertNotPublished(t, events, "sensor_temp", "evt.sensor.report")
+
+	mg.sendCalibrationReport(testDeviceAddr, "sensor_temp", fimpgo.NewNullMessage("cmd.sensor.get_calibration", "sensor_temp", nil, nil, nil))
+	mg.sendCalibrationReport(testDeviceAddr, "sensor_lumin", fimpgo.NewNullMessage("cmd.sensor.get_calibration", "sensor_lumin", nil, nil, nil))
+	events = transport.take()
+	assertDeclared(t, mg, events)
+	assertPublished(t, events, "sensor_temp evt.sensor.calibration_report", "sensor_lumin evt.sensor.calibration_report")
+
+	mg.sendBatteryLevelReport(testDeviceAddr, fimpgo.NewNullMessage("cmd.lvl.get_report", "battery", nil, nil, nil))
+	mg.sendBatteryEstimateReport(testDeviceAddr, fimpgo.NewNullMessage("cmd.battery.get_estimate", "battery", nil, nil, nil))
+	mg.batteryRequests[testDeviceAddr] = []*fimpgo.FimpMessage{fimpgo.NewNullMessage("cmd.lvl.get_report", "battery", nil, nil, nil)}
+	mg.answerBatteryRequests(testDeviceAddr, nil, errors.New("device not found"))
+	events = transport.take()
+	assertDeclared(t, mg, events)
+	assertPublished(t, events, "battery evt.lvl.report", "battery evt.battery.estimate_report", "battery evt.error.report")
+}
+
+// TestProfileEventsMatchServices checks that humidity of thermometer isn't treated as legacy Mi Flora moisture in any migration mode.
+func TestProfileEventsMatchServices(t *testing.T) {
+	for _, mode := range serviceModes {
+		t.Run(mode, func(t *testing.T) {
+			testProfileEvents(t, mode)
+		})
+	}
+}
+
+func testProfileEvents(t *testing.T, mode string) {
+	if err := loadGattProfiles("profiles"); err != nil {
+		t.Fatal(err)
+	}
+	driver, ok := drivers["lywsd03mmc"].(*ProfileDriver)
+	if !ok {
+		t.Fatal("lywsd03mmc profile isn't registered")
+	}
+	var metrics []string
+	for name := range derivedMetrics {
+		metrics = append(metrics, name)
+	}
+	sort.Strings(metrics)
+	config := MifloraConfig{
+		ServiceMode:     mode,
+		DeviceAddresses: []string{testDeviceAddr},
+		Devices:         []DeviceConfig{{Address: testDeviceAddr, Driver: "lywsd03mmc", Calibration: map[string]Calibration{"sensor_humid": {Offset: 2}}}},
+		DerivedMetrics:  metrics,
+	}
+	mg, transport := newTestAdapter(t, config, nil)
+	defer os.RemoveAll(filepath.Dir(mg.configPath))
+
+	// 21.5 C , 45 % and battery voltage of 3 V
+	payload := []byte{0x66, 0x08, 45, 0xb8, 0x0b}
+	reading, err := driver.decode(testDeviceAddr, map[string][]byte{fullUUID("ebe0ccc1-7a0a-4b0c-8a1a-6ff2997da3a6"): payload})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reading.Values) != 2 || reading.Values[0].Value != 21.5 || reading.Values[1].Value != 45 || reading.HasBattery {
+		t.Fatalf("unexpected reading %+v", reading)
+	}
+	mg.publishReading(reading)
+	mg.sendCalibrationReport(testDeviceAddr, "sensor_humid", fimpgo.NewNullMessage("cmd.sensor.get_calibration", "sensor_humid", nil, nil, nil))
+	events := transport.take()
+	assertDeclared(t, mg, events)
+	expected := []string{"sensor_temp evt.sensor.report", "sensor_humid evt.sensor.report", "sensor_humid evt.sensor.calibration_report"}
+	for _, name := range metrics {
+		expected = append(expected, derivedMetrics[name].Service+" evt.sensor.report")
+	}
+	assertPublished(t, events, expected...)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// StreamingDriver is implemented by drivers which can keep connection to the device and deliver values as they arrive.
+type StreamingDriver interface {
+	CanStream() bool
+	// Stream sends readings until the device disconnects or stop is closed. It returns nil only after stop.
+	Stream(addr string, opts ReadOptions, readings chan<- *DeviceReading, stop <-chan struct{}) error
+}
+
+const (
+	defaultMaxConnectionsPerAdapter = 3
+	streamMinBackoff                = 5 * time.Second
+	streamMaxBackoff                = 5 * time.Minute
+	// backoff is reset if connection was held at least that long
+	streamStableDuration = time.Minute
+)
+
+// isStreamingDevice returns true if the device is configured for persistent connection and it's driver supports it.
+func (mg *MiFloraAd) isStreamingDevice(addr string) bool {
+	if !mg.getDeviceConfig(addr).Streaming {
+		return false
+	}
+	sd, ok := mg.driverForDevice(addr).(StreamingDriver)
+	return ok && sd.CanStream()
+}
+
+// ensureStream starts streaming goroutine of the device unless it's already running.
+func (mg *MiFloraAd) ensureStream(addr string) {
+	mg.lock.Lock()
+	defer mg.lock.Unlock()
+	if _, ok := mg.streams[addr]; ok {
+		return
+	}
+	stop := make(chan struct{})
+	mg.streams[addr] = stop
+	go mg.streamDevice(addr, stop)
+}
+
+func (mg *MiFloraAd) stopStream(addr string) {
+	mg.lock.Lock()
+	defer mg.lock.Unlock()
+	if stop, ok := mg.streams[addr]; ok {
+		close(stop)
+		delete(mg.streams, addr)
+	}
+}
+
+// syncStream starts or stops persistent connection after config of the device was changed.
+// Polling of the device is resumed automatically once it isn't streaming.
+func (mg *MiFloraAd) syncStream(addr string) {
+	if mg.isManagedDevice(addr) && mg.isStreamingDevice(addr) {
+		mg.ensureStream(addr)
+	} else {
+		mg.stopStream(addr)
+	}
+}
+
+// connectionSlots returns semaphore which limits number of connections held on the adapter.
+func (mg *MiFloraAd) connectionSlots(adapter string) chan struct{} {
+	mg.lock.Lock()
+	defer mg.lock.Unlock()
+	slots, ok := mg.adapterConnections[adapter]
+	if !ok {
+		max := mg.config.MaxConnectionsPerAdapter
+		if max <= 0 {
+			max = defaultMaxConnectionsPerAdapter
+		}
+		slots = make(chan struct{}, max)
+		mg.adapterConnections[adapter] = slots
+	}
+	return slots
+}
+
+// streamDevice keeps persistent connection to the device and reconnects with exponential backoff.
+func (mg *MiFloraAd) streamDevice(addr string, stop chan struct{}) {
+	defer func() {
+		mg.lock.Lock()
+		if mg.streams[addr] == stop {
+			delete(mg.streams, addr)
+		}
+		mg.lock.Unlock()
+	}()
+	backoff := streamMinBackoff
+	for {
+		if !mg.isManagedDevice(addr) || !mg.isStreamingDevice(addr) {
+			return
+		}
+		adapter := mg.adapterForDevice(addr).Name
+		slots := mg.connectionSlots(adapter)
+		select {
+		case slots <- struct{}{}:
+		case <-stop:
+			return
+		}
+		log.Infof("<Ad> Opening persistent connection to %s over %s", addr, adapter)
+		started := time.Now()
+		err := mg.runStream(addr, adapter, stop)
+		<-slots
+		if err == nil {
+			return
+		}
+		log.Warnf("<Ad> Persistent connection to %s failed : %s", addr, err)
+		mg.recordReadResult(addr, NewDeviceReading(addr, ""), err)
+		if time.Since(started) >= streamStableDuration {
+			backoff = streamMinBackoff
+		}
+		select {
+		case <-time.After(backoff):
+		case <-stop:
+			return
+		}
+		backoff *= 2
+		if backoff > streamMaxBackoff {
+			backoff = streamMaxBackoff
+		}
+	}
+}
+
+func (mg *MiFloraAd) runStream(addr string, adapter string, stop chan struct{}) error {
+	sd := mg.driverForDevice(addr).(StreamingDriver)
+	readings := make(chan *DeviceReading)
+	result := make(chan error, 1)
+	go func() {
+		result <- sd.Stream(addr, ReadOptions{Adapter: adapter, RetryCount: mg.config.RetryCount}, readings, stop)
+	}()
+	connected := false
+	for {
+		select {
+		case reading := <-readings:
+			// BlueZ reports RSSI only during discovery , so connected devices have none
+			mg.recordReadResult(addr, reading, nil)
+			if !connected {
+				// first reading arrives after connect and setup , device information is read over the same connection
+				connected = true
+				mg.updateDeviceInfo(reading, adapter, true)
+			}
+			mg.publishReading(reading)
+		case err := <-result:
+			return err
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/muka/go-bluetooth/linux"
+)
+
+const AdapterStateResetting = "resetting"
+
+const dbusErrorThreshold = 3
+const defaultAdapterResetMinInterval = 300 // seconds
+const defaultAdapterMaxResetsPerHour = 4
+
+func (mg *MiFloraAd) isAdapterResetting(adapter *HciAdapter) bool {
+	mg.lock.Lock()
+	defer mg.lock.Unlock()
+	return adapter.State == AdapterStateResetting
+}
+
+// canResetAdapter applies rate limiting , so a dead controller is not reset in a loop.
+// Must be called with lock held.
+func (mg *MiFloraAd) canResetAdapter(adapter *HciAdapter) bool {
+	minInterval := mg.config.AdapterResetMinInterval
+	if minInterval == 0 {
+		minInterval = defaultAdapterResetMinInterval
+	}
+	maxPerHour := mg.config.AdapterMaxResetsPerHour
+	if maxPerHour == 0 {
+		maxPerHour = defaultAdapterMaxResetsPerHour
+	}
+	var recent []time.Time
+	for _, t := range adapter.resetTimes {
+		if time.Since(t) < time.Hour {
+			recent = append(recent, t)
+		}
+	}
+	adapter.resetTimes = recent
+	if len(recent) >= maxPerHour {
+		return false
+	}
+	if len(recent) > 0 && time.Since(recent[len(recent)-1]) < time.Duration(minInterval)*time.Second {
+		return false
+	}
+	return true
+}
+
+// healAdapter power cycles the adapter over mgmt interface and falls back to full mgmt reset.
+// Polling of devices assigned to the adapter is resumed once the adapter is back.
+func (mg *MiFloraAd) healAdapter(adapter *HciAdapter) {
+	mg.lock.Lock()
+	if !mg.canResetAdapter(adapter) {
+		mg.lock.Unlock()
+		log.Debugf("<Ad> Reset of adapter %s is postponed by rate limiter", adapter.Name)
+		return
+	}
+	prevState := adapter.State
+	adapter.resetTimes = append(adapter.resetTimes, time.Now())
+	adapter.setState(AdapterStateResetting)
+	mg.lock.Unlock()
+	mg.publishAdapterStatus(adapter)
+
+	log.Infof("<Ad> Resetting adapter %s (state %s)", adapter.Name, prevState)
+	err := resetAdapter(adapter.Name)
+
+	mg.lock.Lock()
+	if err != nil {
+		log.Errorf("<Ad> Reset of adapter %s failed : %s", adapter.Name, err)
+		adapter.setState(prevState)
+	} else {
+		log.Infof("<Ad> Adapter %s was reset", adapter.Name)
+		adapter.resetFailures()
+		adapter.DbusErrors = 0
+		adapter.setState(AdapterStateUp)
+	}
+	mg.lock.Unlock()
+	mg.publishAdapterStatus(adapter)
+	if err != nil {
+		return
+	}
+	mg.assignDevices()
+	for _, addr := range mg.deviceList() {
+		if mg.adapterForDevice(addr) == adapter {
+			mg.enqueueSensorRequest(addr)
+		}
+	}
+}
+
+func resetAdapter(name string) error {
+	mgmt := linux.NewBtMgmt(name)
+	err := mgmt.SetPowered(false)
+	if err == nil {
+		time.Sleep(1 * time.Second)
+		err = mgmt.SetPowered(true)
+	}
+	if err != nil {
+		log.Infof("<Ad> Power cycle of %s failed : %s , doing mgmt reset", name, err)
+		err = mgmt.Reset()
+	}
+	return err
+}